@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	// Clients started together must not retry in lockstep.
+	rand.Seed(time.Now().UnixNano())
+}
+
+// Randomised exponential backoff between polls that failed.
+// Not safe for concurrent use, it is only used by the poll loop.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max, current: min}
+}
+
+// How long to wait before the next attempt. Each call doubles the
+// interval up to max, the returned value is jittered between half and all of it.
+func (b *backoff) Next() time.Duration {
+	d := b.current
+	b.current *= 2
+	if b.current > b.max || b.current <= 0 {
+		b.current = b.max
+	}
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// Go back to the minimum interval after a successful poll.
+func (b *backoff) Reset() {
+	b.current = b.min
+}
+
+// Returned by a poll the proxy turned away with a Retry-After header.
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (e retryAfterError) Error() string {
+	return fmt.Sprintf("proxy asked to retry after %s", e.wait)
+}
+
+// The wait a Retry-After header asks for, in seconds or as an HTTP date.
+func retryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// A random wait between 0 and max.
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// Wait at least what the proxy asked for, plus up to half again so clients
+// turned away together come back spread out.
+func (e retryAfterError) jittered() time.Duration {
+	if e.wait <= 1 {
+		return e.wait
+	}
+	return e.wait + time.Duration(rand.Int63n(int64(e.wait/2)+1))
+}
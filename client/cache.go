@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/adobe/pushprox/util"
+)
+
+// A scrape result that could not be pushed to the proxy.
+type pendingPush struct {
+	resp        *http.Response
+	body        *util.SpillBuffer
+	url         *url.URL
+	origRequest *http.Request
+	// Releases the context of origRequest, which lives until the scrape's deadline.
+	cancel context.CancelFunc
+}
+
+// Whether Prometheus is still waiting for this result.
+func (p *pendingPush) live() bool {
+	return p.origRequest.Context().Err() == nil
+}
+
+// Let go of the result once it is pushed or dropped.
+func (p *pendingPush) close() {
+	p.body.Close()
+	p.cancel()
+}
+
+// Holds the last few scrape results that failed to push, so they can be
+// pushed again once the proxy is reachable. Results are only kept until
+// their scrape times out, after that the proxy has given up on them.
+type pushCache struct {
+	mu      sync.Mutex
+	size    int
+	entries []*pendingPush // Oldest first.
+}
+
+func newPushCache(size int) *pushCache {
+	return &pushCache{size: size}
+}
+
+// Keep p, dropping the oldest result if the cache is full. Takes over p.
+func (pc *pushCache) add(p *pendingPush) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	id := p.origRequest.Header.Get(util.IDHeader)
+	for i, e := range pc.entries {
+		if e.origRequest.Header.Get(util.IDHeader) == id {
+			e.close()
+			pc.entries = append(pc.entries[:i], pc.entries[i+1:]...)
+			break
+		}
+	}
+	if len(pc.entries) >= pc.size {
+		pc.entries[0].close()
+		pc.entries = pc.entries[1:]
+	}
+	pc.entries = append(pc.entries, p)
+}
+
+// Remove and return the results still worth pushing, dropping the rest.
+// The caller takes them over.
+func (pc *pushCache) take() []*pendingPush {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	var live []*pendingPush
+	for _, e := range pc.entries {
+		if e.live() {
+			live = append(live, e)
+		} else {
+			e.close()
+		}
+	}
+	pc.entries = nil
+	return live
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// How long a --check poll is held open to confirm the proxy accepted it.
+const checkPollTime = 2 * time.Second
+
+// Poll every proxy and fetch the pull URL of every target once, printing
+// OK or FAIL for each. Returns whether everything was OK.
+func runCheck(proxies []*url.URL, ts []target) bool {
+	client := &http.Client{Transport: transport}
+	ok := true
+	report := func(what string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Printf("FAIL %s: %s\n", what, err)
+			return
+		}
+		fmt.Printf("OK   %s\n", what)
+	}
+	for _, t := range ts {
+		for _, p := range proxies {
+			report(fmt.Sprintf("poll %s as %v", p, t.keys), checkPoll(client, p, t))
+		}
+		report(fmt.Sprintf("pull %s", t.pullURL), checkPull(&http.Client{Transport: pullTransport}, t))
+	}
+	return ok
+}
+
+// Register t with the proxy at base and deregister it again. The proxy only
+// answers a healthy poll once there is a scrape, so a poll still open after
+// checkPollTime counts as accepted. A scrape the proxy hands over meanwhile is
+// failed back with a 503, so Prometheus doesn't wait for it.
+func checkPoll(client *http.Client, base *url.URL, t target) error {
+	pollRequest, err := newPollRequest(base, t, checkPollTime)
+	if err != nil {
+		return err
+	}
+	// Without keepalives the answer is the scrape, or a 204 once we deregister.
+	pollRequest.Header.Del("X-PushProx-Keepalive")
+	// Only reached if deregistering fails, as it does without --web.auth-token on
+	// the proxy. Advertising checkPollTime as our poll interval then makes the
+	// proxy forget the registration soon after.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*checkPollTime)
+	defer cancel()
+	release := time.AfterFunc(checkPollTime, func() { deregisterCheck(client, base, t) })
+	resp, err := client.Do(pollRequest.WithContext(ctx))
+	if err != nil {
+		release.Stop()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if release.Stop() {
+		// Answered before we got to deregister.
+		deregisterCheck(client, base, t)
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusOK:
+		request, err := readScrapeRequest(bufio.NewReader(resp.Body))
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), GetScrapeTimeout(request.Header))
+		defer cancel()
+		c := &Coordinator{logger: log.NewNopLogger(), proxyURL: base}
+		c.pushError(request.WithContext(ctx), client, http.StatusServiceUnavailable, "check", "Scrape sent to a client running --check", c.logger)
+		return nil
+	}
+	return fmt.Errorf("proxy answered %s", resp.Status)
+}
+
+// Deregister the keys of t from the proxy at base, which releases the poll of
+// checkPoll. A client already running for them registers again with its next poll.
+func deregisterCheck(client *http.Client, base *url.URL, t target) {
+	for _, key := range t.keys {
+		u, err := url.Parse(proxyPath("/clients/" + key))
+		if err != nil {
+			continue
+		}
+		request, err := http.NewRequest(http.MethodDelete, base.ResolveReference(u).String(), nil)
+		if err != nil {
+			continue
+		}
+		request.Header.Set("User-Agent", *proxyUserAgent)
+		if proxyToken != "" {
+			request.Header.Set("Authorization", "Bearer "+proxyToken)
+		}
+		if resp, err := client.Do(request); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// Fetch the pull URL of t once.
+func checkPull(client *http.Client, t target) error {
+	request, err := http.NewRequest("GET", t.pullURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("x-prom-pull-token", pullToken())
+	if *pullUserAgent != "" {
+		request.Header.Set("User-Agent", *pullUserAgent)
+	}
+	if *pullUsername != "" {
+		request.SetBasicAuth(*pullUsername, pullPassword)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *defaultScrapeTimeout)
+	defer cancel()
+	resp, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("target answered %s", resp.Status)
+	}
+	return nil
+}
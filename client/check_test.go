@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+)
+
+// A proxy for --check that answers polls with handle and records pushes and
+// deregistrations.
+type checkProxy struct {
+	mu           sync.Mutex
+	pushed       []*http.Response
+	deregistered []string
+	released     chan struct{}
+}
+
+func (p *checkProxy) serve(t *testing.T, handle func(w http.ResponseWriter, released <-chan struct{})) (*httptest.Server, *url.URL) {
+	p.released = make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/poll":
+			handle(w, p.released)
+		case r.URL.Path == "/push":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(gz), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			p.mu.Lock()
+			p.pushed = append(p.pushed, resp)
+			p.mu.Unlock()
+		case r.Method == http.MethodDelete:
+			p.mu.Lock()
+			if len(p.deregistered) == 0 {
+				close(p.released)
+			}
+			p.deregistered = append(p.deregistered, r.URL.Path)
+			p.mu.Unlock()
+		}
+	}))
+	u, _ := url.Parse(srv.URL)
+	return srv, u
+}
+
+func checkTarget() target {
+	u, _ := url.Parse("http://127.0.0.1:9100/metrics")
+	return target{keys: []string{"host:9100"}, pullURL: u}
+}
+
+func TestCheckPollDeregisters(t *testing.T) {
+	var p checkProxy
+	srv, u := p.serve(t, func(w http.ResponseWriter, released <-chan struct{}) {
+		<-released
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer srv.Close()
+
+	start := time.Now()
+	if err := checkPoll(http.DefaultClient, u, checkTarget()); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took >= 2*checkPollTime {
+		t.Errorf("poll was only released by the timeout after %v", took)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.deregistered) != 1 || p.deregistered[0] != "/clients/host:9100" {
+		t.Errorf("got deregistrations %v", p.deregistered)
+	}
+}
+
+func TestCheckPollFailsScrape(t *testing.T) {
+	var p checkProxy
+	srv, u := p.serve(t, func(w http.ResponseWriter, released <-chan struct{}) {
+		w.Write([]byte("GET http://host:9100/metrics?_pushprox_id=7 HTTP/1.1\r\nHost: host:9100\r\nId: 7\r\n\r\n"))
+	})
+	defer srv.Close()
+
+	if err := checkPoll(http.DefaultClient, u, checkTarget()); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pushed) != 1 {
+		t.Fatalf("got %d pushes, want 1", len(p.pushed))
+	}
+	if resp := p.pushed[0]; resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(util.IDHeader) != "7" {
+		t.Errorf("pushed %s for scrape %q, want a 503 for 7", resp.Status, resp.Header.Get(util.IDHeader))
+	}
+	if len(p.deregistered) != 1 {
+		t.Errorf("got deregistrations %v", p.deregistered)
+	}
+}
@@ -5,16 +5,26 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"compress/gzip"
+	"crypto/tls"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/adobe/pushprox/util"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/ShowMax/go-fqdn"
@@ -22,126 +32,610 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
+	"github.com/prometheus/common/version"
 )
 
 var (
-	myFqdn   = kingpin.Flag("fqdn", "FQDN to register with, typically best to use the default").Default(fqdn.Get()).String()
+	myFqdn   = kingpin.Flag("fqdn", "FQDN to register with, typically best to use the default. Repeat to serve several FQDNs over one poll connection.").Default(fqdn.Get()).Strings()
 	loggerName   = kingpin.Flag("loggername", "Logger name to use so that the logs can be filtered").Default("proxyclient").String()
-	pullURL  = kingpin.Flag("pull-url", "Pull URL to use").Required().String()
-	proxyURL = kingpin.Flag("proxy-url", "Push proxy to talk to.").Required().String()
+	pullURL  = kingpin.Flag("pull-url", "Pull URL to use. Repeat to serve several endpoints, each registered under the FQDN with that URL's port.").Required().Strings()
+	pullURLMode = kingpin.Flag("pull-url-mode", "\"override\" always scrapes --pull-url as given, \"path\" scrapes the path Prometheus requested on the --pull-url host, \"scheme\" scrapes --pull-url with the scheme Prometheus requested.").Default("override").Enum("override", "path", "scheme")
+	proxyURLs = kingpin.Flag("proxy-url", "Push proxy to talk to. Repeat or separate with commas to register with several proxies at once.").Required().Strings()
+	proxyPathPrefix = kingpin.Flag("proxy-path-prefix", "Path prefix the proxy serves /poll and /push under, matching its --web.route-prefix.").Default("").String()
+	telemetryAddress = kingpin.Flag("web.telemetry-address", "Serve the client's own Prometheus metrics on this address, such as :9369. Empty disables.").Default("").String()
+	// The old name of --web.telemetry-address.
+	metricsAddr = kingpin.Flag("metrics-addr", "Deprecated, use --web.telemetry-address.").Default("").Hidden().String()
+	pollWeight = kingpin.Flag("poll.weight", "This client's share of the scrapes of its FQDNs, relative to other clients polling for them, when the proxy runs with --scrape.select-strategy=weighted.").Default("1").Int()
+	pollTimeout = kingpin.Flag("poll.timeout", "Give up on a poll that has had no answer for this long and poll again. Should be a little longer than the proxy's --registration.timeout.").Default("5m30s").Duration()
+	pushSpillThreshold = kingpin.Flag("push.spill-threshold-bytes", "Scrape results larger than this are buffered in a temporary file instead of memory. 0 disables.").Default("0").Int64()
+	pushCompression = kingpin.Flag("push.compression", "Gzip scrape results sent to the proxy.").Default("true").Bool()
+	pushRetries = kingpin.Flag("push.retries", "How many times to retry pushing a scrape result to the proxy if it fails.").Default("0").Int()
+	exitOnAuthFailure = kingpin.Flag("poll.exit-on-auth-failure", "Exit instead of retrying when the proxy rejects the client with a 401 or 403.").Default("false").Bool()
+	backoffMin = kingpin.Flag("poll.backoff-min", "Initial delay before retrying a failed poll.").Default("1s").Duration()
+	backoffMax = kingpin.Flag("poll.backoff-max", "Maximum delay between retries of a failed poll.").Default("30s").Duration()
+	startupJitter = kingpin.Flag("poll.startup-jitter", "Wait a random time up to this long before the first poll, and before reconnecting after losing the proxy, so clients don't all poll at once. 0 disables.").Default("0s").Duration()
+	jitterSeed = kingpin.Flag("poll.jitter-seed", "Seed for the random delays of --poll.startup-jitter and the backoff, to make them repeatable. 0 picks a random one.").Default("0").Int64()
+	proxyTLSCertFile = kingpin.Flag("proxy-tls-cert-file", "Client certificate presented to the proxy, for proxies that require mutual TLS.").Default("").String()
+	proxyTLSKeyFile = kingpin.Flag("proxy-tls-key-file", "Private key of --proxy-tls-cert-file.").Default("").String()
+	labels = kingpin.Flag("label", "Static label as name=value attached to this client's targets in the proxy's /clients output. Repeatable.").Strings()
+	job = kingpin.Flag("job", "Job name advertised to the proxy, shown as the __meta_pushprox_job label in its /clients output for relabeling.").Default("").String()
+	meta = kingpin.Flag("meta", "Metadata as name=value advertised to the proxy, shown as a __meta_pushprox_<name> label in its /clients output for relabeling. Repeatable.").Strings()
+	check = kingpin.Flag("check", "Check that the proxy and every --pull-url can be reached, print the result and exit 0 if all are OK, 1 otherwise.").Default("false").Bool()
+	pushCacheSize = kingpin.Flag("push.cache-size", "How many scrape results that failed to push to keep and push again once a poll to the proxy succeeds. They are dropped when their scrape times out. 0 disables.").Default("0").Int()
+	proxyTransport = kingpin.Flag("proxy-transport", "How to talk to the proxy: \"http\" polls and pushes with a request each, \"websocket\" keeps one connection to the proxy's /ws open for all scrapes.").Default("http").Enum("http", "websocket")
+	pullInsecureSkipVerify = kingpin.Flag("pull.insecure-skip-verify", "Don't verify the TLS certificates of HTTPS pull URLs.").Default("false").Bool()
+	pullCAFile = kingpin.Flag("pull.ca-file", "CA certificates to verify the TLS certificates of HTTPS pull URLs against, instead of the system ones.").Default("").String()
+	pullMaxIdleConns = kingpin.Flag("pull.max-idle-conns", "Most idle connections to the pull URLs kept open for reuse.").Default("100").Int()
+	pullIdleConnTimeout = kingpin.Flag("pull.idle-conn-timeout", "How long an idle connection to a pull URL is kept open for reuse.").Default("90s").Duration()
+	pullTLSHandshakeTimeout = kingpin.Flag("pull.tls-handshake-timeout", "Give up on a TLS handshake with a pull URL after this long.").Default("10s").Duration()
+	pullHTTPProxy = kingpin.Flag("pull.http-proxy", "HTTP proxy to scrape the pull URLs through, overriding HTTP_PROXY, HTTPS_PROXY and NO_PROXY for them.").Default("").String()
+	pullUserAgent = kingpin.Flag("pull.user-agent", "User-Agent sent to the pull URLs. Empty passes on the one Prometheus sent.").Default(defaultUserAgent()).String()
+	proxyUserAgent = kingpin.Flag("proxy-user-agent", "User-Agent sent to the proxy with polls and pushes.").Default(defaultUserAgent()).String()
+	pullUsername = kingpin.Flag("pull.username", "Username for HTTP basic auth on the pull URLs.").Default("").String()
+	pullPasswordFlag = kingpin.Flag("pull.password", "Password for HTTP basic auth on the pull URLs.").Default("").String()
+	pullPasswordFile = kingpin.Flag("pull.password-file", "File holding the password for HTTP basic auth on the pull URLs, instead of --pull.password.").Default("").String()
+	maxConcurrentScrapes = kingpin.Flag("scrape.max-concurrent", "Most scrapes of the pull URLs run at once, any more wait for one to finish. 0 disables.").Default("0").Int()
+	scrapeQueueTimeout = kingpin.Flag("scrape.queue-timeout", "How long a scrape waits for --scrape.max-concurrent before it is failed with a 503. 0 waits for half its timeout, leaving time to report the failure.").Default("0s").Duration()
+	maxQueuedScrapes = kingpin.Flag("scrape.max-queued", "Most scrapes waiting for --scrape.max-concurrent at once, any more are failed with a 503 straight away. 0 allows any number.").Default("0").Int()
+	pullMaxBodyBytes = kingpin.Flag("pull.max-body-bytes", "Largest scrape result read from a pull URL, anything beyond is cut off and the result marked with an X-PushProx-Truncated header. 0 disables.").Default("0").Int64()
+	pullExpectContentTypes = kingpin.Flag("pull.expect-content-type", "Media type scrape results must have, e.g. text/plain. Repeatable. Anything else is failed with a 502 instead of being passed on to Prometheus. Empty accepts everything.").Strings()
+	stateFile = kingpin.Flag("state-file", "File used to persist the restart count between runs. Empty disables.").Default("").String()
+	// Sent to the pull URLs unless --pull.token-file is given.
 	promToken = os.Getenv("PROM_TOKEN")
+	// Sent as a bearer token to proxies started with --web.auth-token.
+	proxyToken = os.Getenv("PROXY_TOKEN")
+	labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	// From --pull.password or --pull.password-file.
+	pullPassword string
+	// Used for requests to the proxy, carries the client certificate if there is one.
+	transport http.RoundTripper = http.DefaultTransport
+	// Used for scrapes of the pull URLs, tuned by the --pull.* flags.
+	pullTransport http.RoundTripper = http.DefaultTransport
+	// Sent with every poll so the proxy can tell apart processes using the same FQDN.
+	instanceID = newInstanceID()
 )
 
 type Coordinator struct {
 	logger log.Logger
+	// Results that failed to push, nil if --push.cache-size is 0.
+	cache *pushCache
+	// Holds a token for every scrape running, nil if --scrape.max-concurrent is 0.
+	scrapeSlots chan struct{}
+	// Holds a token for every scrape waiting for scrapeSlots, nil if --scrape.max-queued is 0.
+	queueSlots chan struct{}
+	// Used for all polls and pushes, so they share the idle connections of transport.
+	client *http.Client
+	// The proxy this copy of the coordinator polls and pushes to, one of --proxy-url.
+	proxyURL *url.URL
 }
 
-func (c *Coordinator) doScrape(request *http.Request, client *http.Client) {
-	logger := log.With(c.logger, "scrape_id", request.Header.Get("id"))
-	ctx, _ := context.WithTimeout(request.Context(), GetScrapeTimeout(request.Header))
+// An endpoint the client scrapes, and the keys it is registered under with the proxy.
+// Each target polls over its own connection, so a scrape request and the id it
+// carries always come back to the target that was asked for.
+type target struct {
+	keys    []string
+	pullURL *url.URL
+}
+
+// Work out the targets from --fqdn and --pull-url. A single pull URL is
+// registered under the FQDNs as given, with several each is registered under
+// the FQDNs with the port of its pull URL so the proxy can tell them apart.
+func targets(fqdns []string, pullURLs []string) ([]target, error) {
+	ts := make([]target, 0, len(pullURLs))
+	for _, p := range pullURLs {
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "unix" {
+			if _, _, err := splitUnixPath(u); err != nil {
+				return nil, err
+			}
+		}
+		t := target{keys: fqdns, pullURL: u}
+		if len(pullURLs) > 1 {
+			port := u.Port()
+			if port == "" {
+				port = "80"
+				if u.Scheme == "https" {
+					port = "443"
+				}
+			}
+			t.keys = make([]string, 0, len(fqdns))
+			for _, f := range fqdns {
+				if host, _, err := net.SplitHostPort(f); err == nil {
+					f = host
+				}
+				t.keys = append(t.keys, net.JoinHostPort(f, port))
+			}
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+func (c *Coordinator) doScrape(request *http.Request, client *http.Client, t target) {
+	logger := log.With(c.logger, "scrape_id", request.Header.Get(util.IDHeader))
+	ctx, cancel := context.WithTimeout(request.Context(), GetScrapeTimeout(request.Header))
+	defer cancel()
 	request = request.WithContext(ctx)
 
+	if c.scrapeSlots != nil {
+		if reason := c.waitForScrapeSlot(request); reason != "" {
+			scrapesRejected.WithLabelValues(reason).Inc()
+			level.Warn(logger).Log("msg", "Too many scrapes running, giving up on this one", "url", request.URL.String(), "reason", reason, "max_concurrent", *maxConcurrentScrapes)
+			c.pushError(request, client, http.StatusServiceUnavailable, "overloaded", "Too many concurrent scrapes on the client", logger)
+			return
+		}
+		defer func() { <-c.scrapeSlots }()
+	}
+
 	// We cannot handle http requests at the proxy, as we would only
 	// see a CONNECT, so use a URL parameter to trigger it.
 	params := request.URL.Query()
+	params.Del(util.IDParam)
 
 	// override the url from the server adn use the configured url.\
 	// this has beem checked already.
-	pullU, err := url.Parse(*pullURL)
-	request.URL = pullU;
+	pullU := *t.pullURL
+	switch *pullURLMode {
+	case "path":
+		// keep the path Prometheus asked for, only the scheme and host are fixed.
+		pullU.Path = request.URL.Path
+		pullU.RawPath = request.URL.RawPath
+		if pullU.Scheme == "unix" {
+			socket, _, _ := splitUnixPath(t.pullURL)
+			pullU.Path = socket + ":" + request.URL.Path
+			pullU.RawPath = ""
+		}
+	case "scheme":
+		// keep the scheme Prometheus asked for, which it can only send
+		// as the _scheme parameter, see the README.
+		scheme := request.URL.Scheme
+		if s := params.Get("_scheme"); s != "" {
+			scheme = s
+		}
+		params.Del("_scheme")
+		if (scheme == "http" || scheme == "https") && pullU.Scheme != "unix" {
+			pullU.Scheme = scheme
+		}
+	}
+	// The headers stay as Prometheus sent them, so Accept and Accept-Encoding
+	// negotiate the format with the target, e.g. OpenMetrics.
+	request.URL = &pullU
 	request.URL.RawQuery = params.Encode()
-	request.Header.Set("x-prom-pull-token", promToken)
+	request.Header.Set("x-prom-pull-token", pullToken())
+	if *pullUserAgent != "" {
+		request.Header.Set("User-Agent", *pullUserAgent)
+	}
+	if *pullUsername != "" {
+		request.SetBasicAuth(*pullUsername, pullPassword)
+	}
 
-	scrapeResp, err := client.Do(request)
+	start := time.Now()
+	scrapeResp, err := (&http.Client{Transport: pullTransport}).Do(request)
+	scrapeDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		msg := fmt.Sprintf("Failed to scrape %s: %s", request.URL.String(), err)
-		level.Warn(logger).Log("msg", msg)
-		resp := &http.Response{
-			StatusCode: 500,
-			Header:     http.Header{},
-			Body:       ioutil.NopCloser(strings.NewReader(msg)),
-		}
-		err = c.doPush(resp, request, client)
-		if err != nil {
-			msg2 := fmt.Sprintf("Failed to push failed scrape response from %s: %s", request.URL.String(), err)
-			level.Warn(logger).Log("msg", msg2)
-			return
-		}
+		level.Warn(logger).Log("msg", "Failed to scrape", "url", request.URL.String(), "err", err)
+		// Tells the proxy and Prometheus it was the target that failed, not the proxy.
+		c.pushError(request, client, 500, "upstream", fmt.Sprintf("Failed to scrape %s: %s", request.URL.String(), err), logger)
+		return
+	}
+	if ct := scrapeResp.Header.Get("Content-Type"); len(*pullExpectContentTypes) > 0 && !mediaTypeIn(ct, *pullExpectContentTypes) {
+		// Most likely an HTML error or login page, which Prometheus would only fail to parse.
+		scrapeResp.Body.Close()
+		level.Warn(logger).Log("msg", "Scrape returned an unexpected content type", "url", request.URL.String(), "status", scrapeResp.StatusCode, "content_type", ct)
+		c.pushError(request, client, http.StatusBadGateway, "content_type", fmt.Sprintf("%s answered %s with Content-Type %q, expected %s", request.URL.String(), scrapeResp.Status, ct, strings.Join(*pullExpectContentTypes, " or ")), logger)
 		return
 	}
 	err = c.doPush(scrapeResp, request, client)
 	if err != nil {
-		msg2 := fmt.Sprintf("Failed to push failed scrape response from %s: %s", request.URL.String(), err)
-		level.Warn(logger).Log("msg", msg2)
+		level.Warn(logger).Log("msg", "Failed to push scrape response", "url", request.URL.String(), "err", err)
 		return
 	}
 }
 
+// Whether the media type of the Content-Type header ct is one of types, ignoring parameters such as the version.
+func mediaTypeIn(ct string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if strings.EqualFold(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait for one of the --scrape.max-concurrent slots, for up to --scrape.queue-timeout.
+// Returns why it gave up, "queue_full" or "queue_timeout", or "" once it has a slot.
+func (c *Coordinator) waitForScrapeSlot(request *http.Request) string {
+	select {
+	case c.scrapeSlots <- struct{}{}:
+		return ""
+	default:
+	}
+	if c.queueSlots != nil {
+		select {
+		case c.queueSlots <- struct{}{}:
+			defer func() { <-c.queueSlots }()
+		default:
+			return "queue_full"
+		}
+	}
+	scrapeQueueDepth.Inc()
+	defer scrapeQueueDepth.Dec()
+	wait := *scrapeQueueTimeout
+	if wait <= 0 {
+		deadline, _ := request.Context().Deadline()
+		wait = time.Until(deadline) / 2
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case c.scrapeSlots <- struct{}{}:
+		return ""
+	case <-timer.C:
+		return "queue_timeout"
+	}
+}
+
+// Push a failed scrape as a response with status and msg as the body, and
+// class in the scrape error header to tell where it failed.
+func (c *Coordinator) pushError(request *http.Request, client *http.Client, status int, class, msg string, logger log.Logger) {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(msg)),
+	}
+	resp.Header.Set(util.ScrapeErrorHeader, class)
+	if err := c.doPush(resp, request, client); err != nil {
+		level.Warn(logger).Log("msg", "Failed to push failed scrape response", "url", request.URL.String(), "err", err)
+	}
+}
+
 // Report the result of the scrape back up to the proxy.
 func (c *Coordinator) doPush(resp *http.Response, origRequest *http.Request, client *http.Client) error {
-	resp.Header.Set("id", origRequest.Header.Get("id")) // Link the request and response
-	// Remaining scrape deadline.
-	deadline, _ := origRequest.Context().Deadline()
-	resp.Header.Set("X-Prometheus-Scrape-Timeout", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
-
-	base, err := url.Parse(*proxyURL)
+	u, err := url.Parse(proxyPath("/push"))
 	if err != nil {
 		return err
 	}
-	u, err := url.Parse("/push")
+	// The scrape came from this proxy, so it is the one waiting for the result.
+	url := c.proxyURL.ResolveReference(u)
+
+	// Hold on to the body so the response can be serialized again for retries,
+	// spilling it to disk if it is large.
+	body := util.NewSpillBuffer(*pushSpillThreshold)
+	if *pullMaxBodyBytes > 0 {
+		// One byte more than allowed tells that the target sent too much.
+		_, err = io.Copy(body, io.LimitReader(resp.Body, *pullMaxBodyBytes+1))
+		if err == nil && body.Len() > *pullMaxBodyBytes {
+			level.Warn(c.logger).Log("msg", "Truncating scrape result", "scrape_id", origRequest.Header.Get(util.IDHeader), "limit", *pullMaxBodyBytes)
+			resp.Header.Set("X-PushProx-Truncated", "true")
+			err = body.Truncate(*pullMaxBodyBytes)
+		}
+	} else {
+		_, err = io.Copy(body, resp.Body)
+	}
+	resp.Body.Close()
 	if err != nil {
+		body.Close()
+		return err
+	}
+	start := time.Now()
+	err = c.pushWithRetries(resp, body, url, origRequest, client)
+	pushDuration.Observe(time.Since(start).Seconds())
+	if err != nil && c.cache != nil && origRequest.Context().Err() == nil {
+		// The proxy may be back before Prometheus gives up on the scrape.
+		level.Info(c.logger).Log("msg", "Keeping scrape result to push again later", "scrape_id", origRequest.Header.Get(util.IDHeader), "err", err)
+		// doScrape cancels the scrape's context once it returns, the result
+		// stays worth pushing until the deadline.
+		deadline, _ := origRequest.Context().Deadline()
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		c.cache.add(&pendingPush{resp: resp, body: body, url: url, origRequest: origRequest.WithContext(ctx), cancel: cancel})
 		return err
 	}
-	url := base.ResolveReference(u)
+	body.Close()
+	return err
+}
+
+// Push the results in the cache again, putting back those that fail.
+func (c *Coordinator) flushPushCache(client *http.Client) {
+	for _, p := range c.cache.take() {
+		err := c.pushOnce(p.resp, p.body, p.url, p.origRequest, client)
+		if err != nil && p.live() {
+			c.cache.add(p)
+			continue
+		}
+		p.close()
+		if err == nil {
+			level.Info(c.logger).Log("msg", "Pushed cached scrape result", "scrape_id", p.origRequest.Header.Get(util.IDHeader))
+		}
+	}
+}
+
+// Push a buffered scrape result, retrying up to --push.retries times.
+func (c *Coordinator) pushWithRetries(resp *http.Response, body *util.SpillBuffer, url *url.URL, origRequest *http.Request, client *http.Client) error {
+	bo := newBackoff(100*time.Millisecond, 2*time.Second)
+	for attempt := 0; ; attempt++ {
+		err := c.pushOnce(resp, body, url, origRequest, client)
+		if err == nil || attempt >= *pushRetries {
+			return err
+		}
+		wait := bo.Next()
+		deadline, ok := origRequest.Context().Deadline()
+		if ok && time.Now().Add(wait).After(deadline) {
+			// No point retrying, the proxy has given up on this scrape by now.
+			return err
+		}
+		level.Warn(c.logger).Log("msg", "Retrying push", "scrape_id", origRequest.Header.Get(util.IDHeader), "attempt", attempt+1, "err", err)
+		time.Sleep(wait)
+	}
+}
 
-	buf := &bytes.Buffer{}
-	resp.Write(buf)
+// Serialize resp with the given body and POST it to the proxy.
+func (c *Coordinator) pushOnce(resp *http.Response, body *util.SpillBuffer, url *url.URL, origRequest *http.Request, client *http.Client) error {
+	resp.Header.Set(util.IDHeader, origRequest.Header.Get(util.IDHeader)) // Link the request and response
+	// Remaining scrape deadline.
+	deadline, _ := origRequest.Context().Deadline()
+	resp.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
+	resp.Body = ioutil.NopCloser(body.Reader())
+	resp.ContentLength = body.Len()
+	resp.TransferEncoding = nil
+	if len(resp.Trailer) > 0 {
+		// Write only sends trailers with a chunked body.
+		resp.ContentLength = -1
+		resp.TransferEncoding = []string{"chunked"}
+	}
+
+	buf := util.NewSpillBuffer(*pushSpillThreshold)
+	defer buf.Close()
+	header := http.Header{}
+	if *pushCompression {
+		header.Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(buf)
+		if err := resp.Write(gz); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	} else if err := resp.Write(buf); err != nil {
+		return err
+	}
+	header.Set("User-Agent", *proxyUserAgent)
+	if proxyToken != "" {
+		header.Set("Authorization", "Bearer "+proxyToken)
+	}
 	request := &http.Request{
 		Method:        "POST",
 		URL:           url,
-		Body:          ioutil.NopCloser(buf),
-		ContentLength: int64(buf.Len()),
+		Header:        header,
+		Body:          ioutil.NopCloser(buf.Reader()),
+		ContentLength: buf.Len(),
 	}
 	request = request.WithContext(origRequest.Context())
-	_, err = client.Do(request)
+	pushResp, err := client.Do(request)
 	if err != nil {
 		return err
 	}
+	pushResp.Body.Close()
+	if pushResp.StatusCode >= 500 || pushResp.StatusCode == http.StatusRequestTimeout {
+		// The proxy, or a load balancer in front of it, may be restarting.
+		return fmt.Errorf("push failed with status %s", pushResp.Status)
+	}
+	if pushResp.StatusCode >= 400 {
+		// Pushing the same result again won't change the proxy's mind, such as
+		// a 410 for a scrape it already gave up on.
+		level.Warn(c.logger).Log("msg", "Proxy rejected push", "scrape_id", origRequest.Header.Get(util.IDHeader), "status", pushResp.Status)
+	}
 	return nil
 }
 
-func loop(c Coordinator) {
-	client := &http.Client{}
-	base, err := url.Parse(*proxyURL)
+// The path of a proxy endpoint, under --proxy-path-prefix.
+func proxyPath(endpoint string) string {
+	prefix := strings.Trim(*proxyPathPrefix, "/")
+	if prefix == "" {
+		return endpoint
+	}
+	return "/" + prefix + endpoint
+}
+
+var errAuthRejected = errors.New("authentication rejected by proxy")
+
+// Returned by a poll the proxy refused because another client holds the FQDN.
+var errDuplicateFQDN = errors.New("FQDN registered by another client")
+
+// Returned by a poll the proxy refused as it has --registration.max-clients FQDNs registered.
+var errProxyFull = errors.New("proxy has too many clients registered")
+
+// Returned by a poll answered with a 503 without Retry-After, e.g. while the proxy shuts down.
+var errProxyUnavailable = errors.New("proxy unavailable")
+
+// Parse --proxy-url, splitting values on commas.
+func parseProxyURLs(values []string) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			if u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("%q is not an absolute URL", s)
+			}
+			urls = append(urls, u)
+		}
+	}
+	return urls, nil
+}
+
+// A /poll request to base registering t, telling the proxy we poll every interval.
+func newPollRequest(base *url.URL, t target, interval time.Duration) (*http.Request, error) {
+	u, err := url.Parse(proxyPath("/poll"))
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error parsing url:", "err", err)
-		return
+		return nil, err
 	}
-	u, err := url.Parse("/poll")
+	pollRequest, err := http.NewRequest("POST", base.ResolveReference(u).String(), strings.NewReader(strings.Join(t.keys, "\n")))
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error parsing url:", "err", err)
-		return
+		return nil, err
+	}
+	pollRequest.Header.Set("User-Agent", *proxyUserAgent)
+	pollRequest.Header.Set("X-PushProx-Instance", instanceID)
+	pollRequest.Header.Set("X-PushProx-Weight", strconv.Itoa(*pollWeight))
+	for _, l := range *labels {
+		pollRequest.Header.Add("X-PushProx-Label", l)
+	}
+	if *job != "" {
+		pollRequest.Header.Set("X-PushProx-Job", *job)
 	}
-	url := base.ResolveReference(u)
-	resp, err := client.Post(url.String(), "", strings.NewReader(*myFqdn))
+	for _, m := range *meta {
+		pollRequest.Header.Add("X-PushProx-Meta", m)
+	}
+	if path := metricsPath(t.pullURL); path != "" {
+		pollRequest.Header.Set("X-PushProx-Metrics-Path", path)
+	}
+	if proxyToken != "" {
+		pollRequest.Header.Set("Authorization", "Bearer "+proxyToken)
+	}
+	// We can skip the newlines the proxy sends to keep the poll alive.
+	pollRequest.Header.Set("X-PushProx-Keepalive", "true")
+	pollRequest.Header.Set("X-PushProx-Poll-Interval-Seconds", strconv.FormatFloat(interval.Seconds(), 'f', -1, 64))
+	return pollRequest, nil
+}
+
+// The HTTP path scraped for pullURL, which the proxy lists as the target's
+// __metrics_path__ so Prometheus asks for it.
+func metricsPath(pullURL *url.URL) string {
+	if pullURL.Scheme == "unix" {
+		_, path, _ := splitUnixPath(pullURL)
+		return path
+	}
+	return pullURL.Path
+}
+
+// Read a scrape request the proxy sent, taking the scrape ID from the URL if
+// something stripped the header on the way.
+func readScrapeRequest(r *bufio.Reader) (*http.Request, error) {
+	request, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if request.Header.Get(util.IDHeader) == "" {
+		request.Header.Set(util.IDHeader, request.URL.Query().Get(util.IDParam))
+	}
+	return request, nil
+}
+
+// Poll the proxy once and start a scrape if asked to.
+// Returns an error if the poll failed and should be retried after backing off.
+func loop(c Coordinator, t target) error {
+	client := c.client
+	// A poll is answered or times out within pollTimeout, so that's the longest we go without polling.
+	pollRequest, err := newPollRequest(c.proxyURL, t, *pollTimeout)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Error creating poll request:", "err", err)
+		return err
+	}
+	// Don't let a hung proxy connection wedge the client forever.
+	ctx, cancel := context.WithTimeout(context.Background(), *pollTimeout)
+	defer cancel()
+	if c.cache != nil {
+		// The proxy holds on to polls, so don't wait for an answer to know it is reachable.
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				if info.Err == nil {
+					go c.flushPushCache(client)
+				}
+			},
+		})
+	}
+	resp, err := client.Do(pollRequest.WithContext(ctx))
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			level.Info(c.logger).Log("msg", "Poll timed out, polling again", "timeout", *pollTimeout)
+			return nil
+		}
 		level.Error(c.logger).Log("msg", "Error polling:", "err", err)
-		time.Sleep(time.Second) // Don't pound the server. TODO: Randomised exponential backoff.
-		return
+		return err
 	}
 	defer resp.Body.Close()
-	request, err := http.ReadRequest(bufio.NewReader(resp.Body))
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		// Retrying won't help until the credentials are fixed, so make it obvious.
+		level.Error(c.logger).Log("msg", "Authentication rejected by proxy", "status", resp.Status)
+		if *exitOnAuthFailure {
+			os.Exit(1)
+		}
+		return errAuthRejected
+	}
+	if resp.StatusCode == http.StatusConflict {
+		level.Error(c.logger).Log("msg", "Proxy refused the poll, another client is registered for the same FQDN", "fqdn", strings.Join(t.keys, ","))
+		return errDuplicateFQDN
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		level.Error(c.logger).Log("msg", "Proxy refused the poll, it has too many clients registered", "fqdn", strings.Join(t.keys, ","))
+		return errProxyFull
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		if wait, ok := retryAfter(resp.Header); ok {
+			level.Warn(c.logger).Log("msg", "Proxy is overloaded, backing off", "retry_after", wait)
+			return retryAfterError{wait: wait}
+		}
+		level.Error(c.logger).Log("msg", "Proxy is unavailable", "status", resp.Status)
+		return errProxyUnavailable
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		// The proxy released the poll without a scrape, just poll again.
+		level.Debug(c.logger).Log("msg", "Poll released without a scrape")
+		return nil
+	}
+	body := bufio.NewReader(resp.Body)
+	if seconds, err := strconv.ParseFloat(resp.Header.Get("X-PushProx-Keepalive-Seconds"), 64); err == nil && seconds > 0 {
+		// The proxy writes a newline every so often while we wait, so a poll that
+		// goes quiet for much longer than that is on a dead connection.
+		idle := time.AfterFunc(3*time.Duration(seconds*1e9), cancel)
+		defer idle.Stop()
+		for {
+			b, err := body.ReadByte()
+			if err == io.EOF {
+				// The proxy released the poll without a scrape, just poll again.
+				level.Debug(c.logger).Log("msg", "Poll released without a scrape")
+				return nil
+			}
+			if err != nil {
+				if ctx.Err() == context.DeadlineExceeded {
+					level.Info(c.logger).Log("msg", "Poll timed out, polling again", "timeout", *pollTimeout)
+					return nil
+				}
+				level.Error(c.logger).Log("msg", "Error reading poll response:", "err", err)
+				return err
+			}
+			if b != '\n' {
+				body.UnreadByte()
+				break
+			}
+			idle.Reset(3 * time.Duration(seconds*1e9))
+		}
+	}
+	request, err := readScrapeRequest(body)
 	if err != nil {
 		level.Error(c.logger).Log("msg", "Error reading request:", "err", err)
-		return
+		return err
 	}
-	level.Info(c.logger).Log("msg", "Got scrape request", "scrape_id", request.Header.Get("id"), "url", request.URL)
+	level.Info(c.logger).Log("msg", "Got scrape request", "scrape_id", request.Header.Get(util.IDHeader), "url", request.URL)
 
 	request.RequestURI = ""
 
 	request.Host = ""
 
-	go c.doScrape(request, client)
+	go c.doScrape(request, client, t)
+	return nil
 }
 
 func main() {
@@ -155,27 +649,224 @@ func main() {
 	allowedLevel := promlog.AllowedLevel{}
 	allowedLevel.Set("info")
 	flag.AddFlags(kingpin.CommandLine, &allowedLevel)
+	kingpin.Version(version.Print("pushprox-client"))
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
-	logger := promlog.New(allowedLevel)
+	logger := util.NewLogger(allowedLevel, *logFormat)
 	logger = log.With(logger, "logger", *loggerName)
+	if *jitterSeed != 0 {
+		rand.Seed(*jitterSeed)
+	}
 	coordinator := Coordinator{logger: logger}
-	if *proxyURL == "" {
+	if *maxConcurrentScrapes > 0 {
+		coordinator.scrapeSlots = make(chan struct{}, *maxConcurrentScrapes)
+	}
+	if *maxQueuedScrapes > 0 {
+		if *maxConcurrentScrapes <= 0 {
+			level.Error(logger).Log("msg", "--scrape.max-queued needs --scrape.max-concurrent.")
+			os.Exit(1)
+		}
+		coordinator.queueSlots = make(chan struct{}, *maxQueuedScrapes)
+	}
+	if *pushCacheSize > 0 {
+		coordinator.cache = newPushCache(*pushCacheSize)
+	}
+	proxies, err := parseProxyURLs(*proxyURLs)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "--proxy-url not a valid url", "proxy_url", strings.Join(*proxyURLs, ","), "err", err)
+		os.Exit(1)
+	}
+	if len(proxies) == 0 {
 		level.Error(coordinator.logger).Log("msg", "--proxy-url flag must be specified.")
 		os.Exit(1)
 	}
-	if *pullURL == "" {
+	if len(*pullURL) == 0 {
 		level.Error(coordinator.logger).Log("msg", "--pull-url flag must be specified.")
 		os.Exit(1)
 	}
-	_, err := url.Parse(*pullURL)
+	ts, err := targets(*myFqdn, *pullURL)
 	if err != nil {
-		level.Warn(logger).Log("msg", "--pull-url not a valid url valid ", *pullURL, "err", err)
+		level.Warn(logger).Log("msg", "--pull-url not a valid url", "pull_url", strings.Join(*pullURL, ","), "err", err)
+		os.Exit(1)
+	}
+	for _, l := range *labels {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || !labelNameRE.MatchString(parts[0]) {
+			level.Error(logger).Log("msg", "--label must be name=value with a valid Prometheus label name.", "label", l)
+			os.Exit(1)
+		}
+	}
+	for _, m := range *meta {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || !labelNameRE.MatchString(parts[0]) {
+			level.Error(logger).Log("msg", "--meta must be name=value with a valid Prometheus label name.", "meta", m)
+			os.Exit(1)
+		}
+		if parts[0] == "job" {
+			level.Error(logger).Log("msg", "Use --job instead of --meta job=...")
+			os.Exit(1)
+		}
+	}
+	if (*proxyTLSCertFile == "") != (*proxyTLSKeyFile == "") {
+		level.Error(logger).Log("msg", "--proxy-tls-cert-file and --proxy-tls-key-file must be specified together.")
+		os.Exit(1)
+	}
+	var proxyTLSConfig *tls.Config
+	if *proxyTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*proxyTLSCertFile, *proxyTLSKeyFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading client certificate", "err", err)
+			os.Exit(1)
+		}
+		proxyTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tr := newTransport(proxyTLSConfig)
+	// Every endpoint has a poll open to each proxy and may push at the same time,
+	// so keep enough idle connections to not reconnect for each.
+	tr.MaxIdleConnsPerHost = 2 * len(ts)
+	transport = tr
+	if *pullPasswordFlag != "" && *pullPasswordFile != "" {
+		level.Error(logger).Log("msg", "--pull.password and --pull.password-file can't be used together.")
+		os.Exit(1)
+	}
+	pullPassword = *pullPasswordFlag
+	if *pullPasswordFile != "" {
+		b, err := ioutil.ReadFile(*pullPasswordFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error reading --pull.password-file", "err", err)
+			os.Exit(1)
+		}
+		pullPassword = strings.TrimRight(string(b), "\r\n")
+	}
+	if *pullTokenFile != "" {
+		if err := loadPullToken(); err != nil {
+			level.Error(logger).Log("msg", "Error reading --pull.token-file", "err", err)
+			os.Exit(1)
+		}
+		go watchPullToken(logger)
+	}
+	if pullPassword != "" && *pullUsername == "" {
+		level.Error(logger).Log("msg", "A pull password needs --pull.username.")
 		os.Exit(1)
 	}
-	msg := fmt.Sprintf("URL and FQDN info proxy_url %s Using FQDN of %s  and Pull URL %s ", *proxyURL, *myFqdn, *pullURL )
-	level.Info(coordinator.logger).Log("msg", msg)
+	if *pullInsecureSkipVerify && *pullCAFile != "" {
+		level.Error(logger).Log("msg", "--pull.insecure-skip-verify and --pull.ca-file can't be used together, skipping verification ignores the CA.")
+		os.Exit(1)
+	}
+	var pullTLSConfig *tls.Config
+	if *pullInsecureSkipVerify {
+		level.Warn(logger).Log("msg", "Not verifying the TLS certificates of pull URLs.")
+		pullTLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if *pullCAFile != "" {
+		pool, err := util.LoadCAFile(*pullCAFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading --pull.ca-file", "err", err)
+			os.Exit(1)
+		}
+		pullTLSConfig = &tls.Config{RootCAs: pool}
+	}
+	pt := newTransport(pullTLSConfig)
+	pt.MaxIdleConns = *pullMaxIdleConns
+	// Pull URLs are usually all on one host, so don't hold it to the default of 2.
+	pt.MaxIdleConnsPerHost = *pullMaxIdleConns
+	pt.IdleConnTimeout = *pullIdleConnTimeout
+	pt.TLSHandshakeTimeout = *pullTLSHandshakeTimeout
+	if *pullHTTPProxy != "" {
+		u, err := url.Parse(*pullHTTPProxy)
+		if err != nil || u.Host == "" {
+			level.Error(logger).Log("msg", "--pull.http-proxy must be a URL such as http://proxy:3128", "url", *pullHTTPProxy, "err", err)
+			os.Exit(1)
+		}
+		pt.Proxy = http.ProxyURL(u)
+	}
+	pt.RegisterProtocol("unix", newUnixTransport(pt))
+	pullTransport = pt
+	coordinator.client = &http.Client{Transport: transport}
+	for _, t := range ts {
+		level.Info(coordinator.logger).Log("msg", "URL and FQDN info", "instance_id", instanceID, "proxy_url", strings.Join(urlStrings(proxies), ","), "fqdn", strings.Join(t.keys, ","), "pull_url", t.pullURL)
+	}
+	if *check {
+		if !runCheck(proxies, ts) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *stateFile != "" {
+		n, err := bumpRestartCount(*stateFile)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error updating state file", "file", *stateFile, "err", err)
+		}
+		restarts.Add(float64(n))
+	}
+	if *telemetryAddress == "" {
+		*telemetryAddress = *metricsAddr
+	}
+	if *telemetryAddress != "" {
+		go func() {
+			if err := serveMetrics(*telemetryAddress); err != nil {
+				// Scraping and pushing matter more than the client's own metrics.
+				level.Error(logger).Log("msg", "Error serving metrics, continuing without them", "address", *telemetryAddress, "err", err)
+			}
+		}()
+	}
+	// Every target registers with every proxy independently, so any of them can
+	// scrape it while the others are down.
+	for _, p := range proxies {
+		c := coordinator
+		c.proxyURL = p
+		if len(proxies) > 1 {
+			c.logger = log.With(c.logger, "proxy_url", p)
+		}
+		for _, t := range ts {
+			go pollForever(c, t)
+		}
+	}
+	select {}
+}
+
+func urlStrings(urls []*url.URL) []string {
+	s := make([]string, 0, len(urls))
+	for _, u := range urls {
+		s = append(s, u.String())
+	}
+	return s
+}
+
+// Keep polling for t. Blocking.
+func pollForever(c Coordinator, t target) {
+	// Don't pound the server when polls fail.
+	bo := newBackoff(*backoffMin, *backoffMax)
+	poll := loop
+	if *proxyTransport == "websocket" {
+		poll = wsLoop
+	}
+	if wait := randomJitter(*startupJitter); wait > 0 {
+		level.Debug(c.logger).Log("msg", "Waiting before first poll", "wait", wait, "pull_url", t.pullURL)
+		time.Sleep(wait)
+	}
+	// Whether the last poll got through, so a failure now means we lost the proxy.
+	connected := false
 	for {
-		loop(coordinator)
+		if err := poll(c, t); err != nil {
+			wait := bo.Next()
+			if ra, ok := err.(retryAfterError); ok {
+				if w := ra.jittered(); w > wait {
+					wait = w
+				}
+			}
+			if connected {
+				// Probably the proxy restarted, and every other client noticed at the same moment.
+				if w := randomJitter(*startupJitter); w > wait {
+					wait = w
+				}
+			}
+			connected = false
+			level.Debug(c.logger).Log("msg", "Backing off before next poll", "wait", wait, "pull_url", t.pullURL)
+			time.Sleep(wait)
+			continue
+		}
+		connected = true
+		bo.Reset()
 	}
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestMain(m *testing.M) {
+	// Give every flag its default.
+	if _, err := kingpin.CommandLine.Parse([]string{"--pull-url=http://localhost:9100/metrics", "--proxy-url=http://localhost:8080"}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPollRequestMetricsPath(t *testing.T) {
+	base, _ := url.Parse("http://proxy:8080")
+	for pullURL, want := range map[string]string{
+		"http://localhost:9100/metrics":     "/metrics",
+		"http://localhost:9115/probe?x=y":   "/probe",
+		"unix:///run/app.sock:/app/metrics": "/app/metrics",
+		"http://localhost:9100":             "",
+	} {
+		u, _ := url.Parse(pullURL)
+		r, err := newPollRequest(base, target{keys: []string{"host:9100"}, pullURL: u}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Header.Get("X-PushProx-Metrics-Path"); got != want {
+			t.Errorf("%s: got %q, want %q", pullURL, got, want)
+		}
+	}
+}
+
+func TestPollRequestSeveralFQDNs(t *testing.T) {
+	base, _ := url.Parse("http://proxy:8080")
+	pullURL, _ := url.Parse("http://localhost:9100/metrics")
+	r, err := newPollRequest(base, target{keys: []string{"a.example:9100", "b.example:9100"}, pullURL: pullURL}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if got := strings.Fields(string(body)); len(got) != 2 || got[0] != "a.example:9100" || got[1] != "b.example:9100" {
+		t.Errorf("got poll body %q, want both FQDNs", body)
+	}
+}
+
+func TestProxyPath(t *testing.T) {
+	defer func(prefix string) { *proxyPathPrefix = prefix }(*proxyPathPrefix)
+	for prefix, want := range map[string]string{
+		"":           "/poll",
+		"/":          "/poll",
+		"pushprox":   "/pushprox/poll",
+		"/pushprox/": "/pushprox/poll",
+		"/a/b":       "/a/b/poll",
+	} {
+		*proxyPathPrefix = prefix
+		if got := proxyPath("/poll"); got != want {
+			t.Errorf("prefix %q: got %q, want %q", prefix, got, want)
+		}
+	}
+
+	*proxyPathPrefix = "/pushprox/"
+	base, _ := url.Parse("http://proxy:8080")
+	pullURL, _ := url.Parse("http://localhost:9100/metrics")
+	r, err := newPollRequest(base, target{keys: []string{"host:9100"}, pullURL: pullURL}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.URL.String(); got != "http://proxy:8080/pushprox/poll" {
+		t.Errorf("got poll URL %s, want it under the prefix", got)
+	}
+}
+
+func TestReadScrapeRequestID(t *testing.T) {
+	for name, c := range map[string]struct {
+		request, want string
+	}{
+		"header":          {"GET http://host:9100/metrics?_pushprox_id=1 HTTP/1.1\r\nHost: host:9100\r\nId: 1\r\n\r\n", "1"},
+		"lowercase":       {"GET http://host:9100/metrics HTTP/1.1\r\nHost: host:9100\r\nid: 2\r\n\r\n", "2"},
+		"stripped header": {"GET http://host:9100/metrics?_pushprox_id=3 HTTP/1.1\r\nHost: host:9100\r\n\r\n", "3"},
+	} {
+		r, err := readScrapeRequest(bufio.NewReader(strings.NewReader(c.request)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Header.Get(util.IDHeader); got != c.want {
+			t.Errorf("%s: got ID %q, want %q", name, got, c.want)
+		}
+	}
+}
+
+func TestPollAuthRejected(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError} {
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		u, _ := url.Parse(proxy.URL)
+		pullURL, _ := url.Parse("http://localhost:9100/metrics")
+		var logs bytes.Buffer
+		c := Coordinator{logger: log.NewLogfmtLogger(&logs), client: proxy.Client(), proxyURL: u}
+		err := loop(c, target{keys: []string{"host:9100"}, pullURL: pullURL})
+		proxy.Close()
+
+		rejected := status != http.StatusInternalServerError
+		if (err == errAuthRejected) != rejected {
+			t.Errorf("%d: got %v", status, err)
+		}
+		if strings.Contains(logs.String(), "Authentication rejected by proxy") != rejected {
+			t.Errorf("%d: got logs %q", status, logs.String())
+		}
+	}
+}
+
+func TestScrapeHonorsPrometheusTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer exporter.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	pullURL, _ := url.Parse(exporter.URL + "/metrics")
+	c := &Coordinator{logger: log.NewNopLogger(), client: proxy.Client(), proxyURL: proxyURL}
+	request, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	request.Header.Set(util.IDHeader, "1")
+	request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.2")
+
+	start := time.Now()
+	c.doScrape(request, c.client, target{keys: []string{"host:9100"}, pullURL: pullURL})
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("scrape took %v, want it to give up after Prometheus' 200ms", took)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("scrape of the target not cancelled at the timeout")
+	}
+}
+
+// A proxy passing on the scrape results pushed to it, with their bodies read.
+func pushRecorder(t *testing.T) (*httptest.Server, <-chan *http.Response) {
+	pushed := make(chan *http.Response, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			body, _ = gzip.NewReader(r.Body)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(body), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		pushed <- resp
+	}))
+	return proxy, pushed
+}
+
+func TestPushKeepsTrailers(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("up 1\n"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer exporter.Close()
+	proxy, pushed := pushRecorder(t)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	pullURL, _ := url.Parse(exporter.URL + "/metrics")
+	c := &Coordinator{logger: log.NewNopLogger(), client: proxy.Client(), proxyURL: proxyURL}
+	request, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	request.Header.Set(util.IDHeader, "1")
+	c.doScrape(request, c.client, target{keys: []string{"host:9100"}, pullURL: pullURL})
+
+	select {
+	case resp := <-pushed:
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+			t.Errorf("got trailer %q, want %q", got, "abc")
+		}
+	default:
+		t.Fatal("nothing pushed")
+	}
+}
+
+func TestPollsReuseConnection(t *testing.T) {
+	var conns int32
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/poll" {
+			// Released without a scrape.
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	proxy.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	pullURL, _ := url.Parse("http://localhost:9100/metrics")
+	tr := newTransport(nil)
+	defer tr.CloseIdleConnections()
+	c := Coordinator{logger: log.NewNopLogger(), client: &http.Client{Transport: tr}, proxyURL: proxyURL}
+	for i := 0; i < 5; i++ {
+		if err := loop(c, target{keys: []string{"host:9100"}, pullURL: pullURL}); err != nil {
+			t.Fatal(err)
+		}
+		// A failed scrape is pushed in between.
+		request, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+		request.Header.Set(util.IDHeader, strconv.Itoa(i))
+		c.pushError(request, c.client, http.StatusInternalServerError, "upstream", "failed", c.logger)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("5 polls and pushes made %d connections, want 1", n)
+	}
+}
+
+func TestPollLogsScrapeID(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up 1\n"))
+	}))
+	defer exporter.Close()
+	pushed := make(chan struct{})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/push" {
+			close(pushed)
+			return
+		}
+		w.Write([]byte("GET http://host:9100/metrics?_pushprox_id=7 HTTP/1.1\r\nHost: host:9100\r\nId: 7\r\n\r\n"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	pullURL, _ := url.Parse(exporter.URL + "/metrics")
+	var (
+		mu   sync.Mutex
+		logs bytes.Buffer
+	)
+	logger := log.NewLogfmtLogger(&logs)
+	c := Coordinator{logger: log.LoggerFunc(func(keyvals ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return logger.Log(keyvals...)
+	}), client: proxy.Client(), proxyURL: proxyURL}
+	if err := loop(c, target{keys: []string{"host:9100"}, pullURL: pullURL}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape result not pushed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(logs.String(), `msg="Got scrape request" scrape_id=7`) {
+		t.Errorf("poll receipt not logged with the scrape ID: %s", logs.String())
+	}
+}
+
+func TestTargetsInvalidPullURL(t *testing.T) {
+	for _, pullURL := range []string{"http://%zz/metrics", "http://[::1/metrics", "unix://host/app.sock:/metrics", "unix:///app.sock"} {
+		if _, err := targets([]string{"host:9100"}, []string{pullURL}); err == nil {
+			t.Errorf("%s: got no error", pullURL)
+		}
+	}
+	ts, err := targets([]string{"host"}, []string{"http://localhost:9100/metrics", "unix:///run/app.sock:/app/metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 2 || ts[0].pullURL.Host != "localhost:9100" || ts[0].keys[0] != "host:9100" || ts[1].keys[0] != "host:80" {
+		t.Errorf("got targets %+v", ts)
+	}
+}
+
+func TestScrapeUnreachablePullURL(t *testing.T) {
+	proxy, pushed := pushRecorder(t)
+	defer proxy.Close()
+
+	// A port nothing listens on any more.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pullURL, _ := url.Parse("http://" + listener.Addr().String() + "/metrics")
+	listener.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	c := &Coordinator{logger: log.NewNopLogger(), client: proxy.Client(), proxyURL: proxyURL}
+	request, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	request.Header.Set(util.IDHeader, "1")
+	c.doScrape(request, c.client, target{keys: []string{"host:9100"}, pullURL: pullURL})
+
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get(util.ScrapeErrorHeader) != "upstream" {
+			t.Errorf("got %d with scrape error %q pushed, want a 500 blaming the target", resp.StatusCode, resp.Header.Get(util.ScrapeErrorHeader))
+		}
+	default:
+		t.Fatal("nothing pushed")
+	}
+}
+
+func TestScrapeNegotiatesOpenMetrics(t *testing.T) {
+	const accept = "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+	const contentType = "application/openmetrics-text; version=0.0.1; charset=utf-8"
+	var gotAccept, gotEncoding string
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAccept, gotEncoding = r.Header.Get("Accept"), r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte("up 1\n# EOF\n"))
+	}))
+	defer exporter.Close()
+	proxy, pushed := pushRecorder(t)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	pullURL, _ := url.Parse(exporter.URL + "/metrics")
+	c := &Coordinator{logger: log.NewNopLogger(), client: proxy.Client(), proxyURL: proxyURL}
+	request, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	request.Header.Set(util.IDHeader, "1")
+	request.Header.Set("Accept", accept)
+	request.Header.Set("Accept-Encoding", "gzip")
+	c.doScrape(request, c.client, target{keys: []string{"host:9100"}, pullURL: pullURL})
+
+	if gotAccept != accept || gotEncoding != "gzip" {
+		t.Errorf("target got Accept %q and Accept-Encoding %q, want Prometheus' %q and %q", gotAccept, gotEncoding, accept, "gzip")
+	}
+	select {
+	case resp := <-pushed:
+		if got := resp.Header.Get("Content-Type"); got != contentType {
+			t.Errorf("pushed Content-Type %q, want %q", got, contentType)
+		}
+	default:
+		t.Fatal("nothing pushed")
+	}
+}
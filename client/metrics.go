@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+)
+
+var (
+	startTime = time.Now()
+
+	uptime = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_uptime_seconds",
+			Help: "Seconds since the client process started.",
+		},
+		func() float64 { return time.Since(startTime).Seconds() },
+	)
+	restarts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_restarts_total",
+			Help: "Number of times the client has been started before this process, as recorded in the state file.",
+		},
+	)
+	scrapeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_client_scrape_duration_seconds",
+			Help:    "Time from sending a scrape to a pull URL until its response headers arrive.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	scrapeQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_scrape_queue_depth",
+			Help: "Scrapes waiting for one of --scrape.max-concurrent to finish.",
+		},
+	)
+	scrapesRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_scrapes_rejected_total",
+			Help: "Scrapes failed with a 503 as too many were running, by whether the queue was full or they waited too long.",
+		},
+		[]string{"reason"},
+	)
+	pushDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_client_push_duration_seconds",
+			Help:    "Time taken to push a scrape result to the proxy, including retries.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uptime, restarts, scrapeDuration, scrapeQueueDepth, scrapesRejected, pushDuration)
+	prometheus.MustRegister(version.NewCollector("pushprox_client"))
+}
+
+// Serve the client's own metrics. Blocking.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log"
+)
+
+// Push a small scrape result to a proxy answering with statuses in turn,
+// returning the push error and how many pushes were made.
+func pushTo(t *testing.T, retries int, statuses ...int) (error, int) {
+	defer func(v int) { *pushRetries = v }(*pushRetries)
+	*pushRetries = retries
+	var pushes int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&pushes, 1)
+		w.WriteHeader(statuses[int(n-1)%len(statuses)])
+	}))
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL + "/push")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	scrape, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	scrape = scrape.WithContext(ctx)
+	body := util.NewSpillBuffer(0)
+	defer body.Close()
+	body.Write([]byte("up 1\n"))
+	resp := &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}
+
+	c := &Coordinator{logger: log.NewNopLogger()}
+	err := c.pushWithRetries(resp, body, u, scrape, http.DefaultClient)
+	return err, int(atomic.LoadInt32(&pushes))
+}
+
+func TestPushRetriesServerErrors(t *testing.T) {
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusRequestTimeout} {
+		err, pushes := pushTo(t, 2, status, http.StatusOK)
+		if err != nil || pushes != 2 {
+			t.Errorf("after a %d: got %v after %d pushes, want success after 2", status, err, pushes)
+		}
+	}
+	err, pushes := pushTo(t, 1, http.StatusServiceUnavailable)
+	if err == nil || !strings.Contains(err.Error(), "503") || pushes != 2 {
+		t.Errorf("got %v after %d pushes, want a 503 after 2", err, pushes)
+	}
+}
+
+func TestPushDoesNotRetryRejections(t *testing.T) {
+	for _, status := range []int{http.StatusGone, http.StatusBadRequest} {
+		err, pushes := pushTo(t, 2, status, http.StatusOK)
+		if err != nil || pushes != 1 {
+			t.Errorf("after a %d: got %v after %d pushes, want no retry", status, err, pushes)
+		}
+	}
+}
+
+func TestPushTruncatesAtLimit(t *testing.T) {
+	defer func(v int64) { *pullMaxBodyBytes = v }(*pullMaxBodyBytes)
+	defer func(v int64) { *pushSpillThreshold = v }(*pushSpillThreshold)
+	*pullMaxBodyBytes = 4
+	for _, tc := range []struct {
+		body          string
+		spill         int64
+		want          string
+		wantTruncated bool
+	}{
+		{"abc", 0, "abc", false},
+		{"abcd", 0, "abcd", false},
+		{"abcde", 0, "abcd", true},
+		{"abcdefgh", 0, "abcd", true},
+		// Spilled to a file.
+		{"abcd", 2, "abcd", false},
+		{"abcdefgh", 2, "abcd", true},
+	} {
+		*pushSpillThreshold = tc.spill
+		proxy, pushed := pushRecorder(t)
+		proxyURL, _ := url.Parse(proxy.URL)
+		c := &Coordinator{logger: log.NewNopLogger(), proxyURL: proxyURL}
+		request, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(tc.body))}
+		if err := c.doPush(resp, request, proxy.Client()); err != nil {
+			t.Fatalf("%q: %s", tc.body, err)
+		}
+		got := <-pushed
+		b, _ := ioutil.ReadAll(got.Body)
+		if truncated := got.Header.Get("X-PushProx-Truncated") == "true"; string(b) != tc.want || truncated != tc.wantTruncated {
+			t.Errorf("%q spilling past %d: pushed %q truncated %t, want %q truncated %t", tc.body, tc.spill, b, truncated, tc.want, tc.wantTruncated)
+		}
+		proxy.Close()
+	}
+}
+
+func TestCachedPushOutlivesScrape(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up 1\n"))
+	}))
+	defer exporter.Close()
+	var up int32
+	pushed := make(chan struct{}, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		pushed <- struct{}{}
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	pullURL, _ := url.Parse(exporter.URL + "/metrics")
+	c := &Coordinator{logger: log.NewNopLogger(), proxyURL: proxyURL, cache: newPushCache(1)}
+	request, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	request.Header.Set(util.IDHeader, "1")
+	c.doScrape(request, proxy.Client(), target{keys: []string{"host:9100"}, pullURL: pullURL})
+
+	// The scrape is over, but its result is still worth pushing until it times out.
+	atomic.StoreInt32(&up, 1)
+	c.flushPushCache(proxy.Client())
+	select {
+	case <-pushed:
+	default:
+		t.Fatal("cached result not pushed once the proxy was back")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Increment the restart counter kept in path and return the number of
+// previous starts. A missing or unreadable file counts as the first start.
+func bumpRestartCount(path string) (int, error) {
+	restarts := 0
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		restarts, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			restarts = 0
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	// Write to a temporary file first so a crash mid-write can't corrupt the count.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(restarts+1)+"\n"), 0644); err != nil {
+		return restarts, err
+	}
+	return restarts, os.Rename(tmp, path)
+}
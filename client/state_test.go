@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRestartCountPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	// Each call is one start of the client.
+	for want := 0; want < 3; want++ {
+		got, err := bumpRestartCount(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("start %d: got %d previous starts", want, got)
+		}
+	}
+}
+
+func TestRestartCountCorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	ioutil.WriteFile(path, []byte("garbage"), 0644)
+
+	if got, err := bumpRestartCount(path); err != nil || got != 0 {
+		t.Errorf("got %d, %v, want a first start", got, err)
+	}
+	if got, _ := bumpRestartCount(path); got != 1 {
+		t.Errorf("got %d previous starts, want 1", got)
+	}
+}
+
+func TestUptimeIncreases(t *testing.T) {
+	before := testutil.ToFloat64(uptime)
+	time.Sleep(10 * time.Millisecond)
+	if after := testutil.ToFloat64(uptime); after <= before {
+		t.Errorf("uptime went from %v to %v", before, after)
+	}
+}
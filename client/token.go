@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var pullTokenFile = kingpin.Flag("pull.token-file", "File holding the x-prom-pull-token sent to the pull URLs, instead of the PROM_TOKEN environment variable. Reloaded on SIGHUP.").Default("").String()
+
+// The current token from --pull.token-file, a string. Not set without it.
+var pullTokenValue atomic.Value
+
+// The token sent to the pull URLs in x-prom-pull-token.
+func pullToken() string {
+	if t, ok := pullTokenValue.Load().(string); ok {
+		return t
+	}
+	return promToken
+}
+
+// Read --pull.token-file, with surrounding whitespace trimmed. On error the
+// previous token is kept.
+func loadPullToken() error {
+	b, err := ioutil.ReadFile(*pullTokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return errors.New(*pullTokenFile + " is empty")
+	}
+	pullTokenValue.Store(token)
+	return nil
+}
+
+// Read --pull.token-file again every time a SIGHUP is received, so a rotated
+// token takes effect without a restart. Blocking.
+func watchPullToken(logger log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := loadPullToken(); err != nil {
+			level.Error(logger).Log("msg", "Error reloading --pull.token-file, keeping the previous token", "err", err)
+			continue
+		}
+		level.Info(logger).Log("msg", "Reloaded --pull.token-file")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Pull URLs such as unix:///run/app.sock:/metrics scrape the HTTP path after
+// the colon over the Unix socket before it, the way nginx writes them.
+// Split the path of such a URL into the two.
+func splitUnixPath(u *url.URL) (socket, path string, err error) {
+	if u.Host != "" {
+		return "", "", errors.New("a unix pull URL has no host, use unix:///path/to/socket:/metrics")
+	}
+	i := strings.Index(u.Path, ":")
+	if i <= 1 || !strings.HasPrefix(u.Path[i+1:], "/") {
+		return "", "", errors.New("a unix pull URL needs a socket path and an HTTP path, as in unix:///path/to/socket:/metrics")
+	}
+	return u.Path[:i], u.Path[i+1:], nil
+}
+
+// Registered with the pull transport for unix:// URLs. Sends each request as
+// plain HTTP to localhost over the socket of its URL.
+type unixTransport struct {
+	next *http.Transport
+}
+
+// A transport for unix:// pull URLs with the connection pool settings of base,
+// which it is registered with.
+func newUnixTransport(base *http.Transport) *unixTransport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return &unixTransport{next: &http.Transport{
+		// The socket path stands in for the host, so connections are pooled per socket.
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			socket, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+		MaxIdleConns:          base.MaxIdleConns,
+		MaxIdleConnsPerHost:   base.MaxIdleConnsPerHost,
+		IdleConnTimeout:       base.IdleConnTimeout,
+		ExpectContinueTimeout: base.ExpectContinueTimeout,
+	}}
+}
+
+func (t *unixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	socket, path, err := splitUnixPath(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	u := *req.URL
+	u.Scheme = "http"
+	u.Host = socket
+	u.Path = path
+	u.RawPath = ""
+	r := new(http.Request)
+	*r = *req
+	r.URL = &u
+	r.Host = "localhost"
+	return t.next.RoundTrip(r)
+}
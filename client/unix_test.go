@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log"
+)
+
+func TestSplitUnixPath(t *testing.T) {
+	for in, want := range map[string][2]string{
+		"unix:///run/app.sock:/metrics":         {"/run/app.sock", "/metrics"},
+		"unix:///run/app.sock:/app/metrics?x=y": {"/run/app.sock", "/app/metrics"},
+		"unix:///run/app.sock:/":                {"/run/app.sock", "/"},
+		"unix:///run/app.sock":                  {},
+		"unix:///run/app.sock:metrics":          {},
+		"unix://host/run/app.sock:/metrics":     {},
+		"unix://:/metrics":                      {},
+	} {
+		u, _ := url.Parse(in)
+		socket, path, err := splitUnixPath(u)
+		if want[0] == "" {
+			if err == nil {
+				t.Errorf("%s: got %q %q, want an error", in, socket, path)
+			}
+			continue
+		}
+		if err != nil || socket != want[0] || path != want[1] {
+			t.Errorf("%s: got %q %q %v, want %q %q", in, socket, path, err, want[0], want[1])
+		}
+	}
+}
+
+func TestScrapeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotPath, gotQuery, gotHost string
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery, gotHost = r.URL.Path, r.URL.RawQuery, r.Host
+		w.Write([]byte("up 1\n"))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	defer func(t http.RoundTripper) { pullTransport = t }(pullTransport)
+	pt := newTransport(nil)
+	pt.RegisterProtocol("unix", newUnixTransport(pt))
+	pullTransport = pt
+
+	proxy, pushed := pushRecorder(t)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	pullURL, _ := url.Parse("unix://" + socket + ":/app/metrics")
+	c := &Coordinator{logger: log.NewNopLogger(), client: proxy.Client(), proxyURL: proxyURL}
+	request, _ := http.NewRequest("GET", "http://host:9100/metrics?module=x&"+util.IDParam+"=1", nil)
+	request.Header.Set(util.IDHeader, "1")
+	c.doScrape(request, c.client, target{keys: []string{"host:9100"}, pullURL: pullURL})
+
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("pushed %d, want 200", resp.StatusCode)
+		}
+	default:
+		t.Fatal("nothing pushed")
+	}
+	if gotPath != "/app/metrics" || gotQuery != "module=x" || gotHost != "localhost" {
+		t.Errorf("target got path %q, query %q and host %q", gotPath, gotQuery, gotHost)
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
-	"strconv"
 	"time"
 
+	"github.com/adobe/pushprox/util"
+	"github.com/prometheus/common/version"
+
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
@@ -13,17 +19,47 @@ import (
 var (
 	maxScrapeTimeout     = kingpin.Flag("scrape.max-timeout", "Any scrape with a timeout higher than this will have to be clamped to this.").Default("5m").Duration()
 	defaultScrapeTimeout = kingpin.Flag("scrape.default-timeout", "If a scrape lacks a timeout, use this value.").Default("15s").Duration()
+	logFormat            = kingpin.Flag("log.format", "Output format of log messages. One of: [logfmt, json]").Default("logfmt").Enum("logfmt", "json")
 )
 
+// The timeout of a scrape with header h, see util.ParseScrapeTimeout, with
+// --scrape.default-timeout and --scrape.max-timeout.
 func GetScrapeTimeout(h http.Header) time.Duration {
+	return util.ParseScrapeTimeout(h.Get("X-Prometheus-Scrape-Timeout-Seconds"), *defaultScrapeTimeout, *maxScrapeTimeout)
+}
 
-	timeout := *defaultScrapeTimeout
-	timeoutSeconds, err := strconv.ParseFloat(h.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
-	if err == nil {
-		timeout = time.Duration(timeoutSeconds * 1e9)
+// A random version 4 UUID.
+func newInstanceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
-	if timeout > *maxScrapeTimeout {
-		timeout = *maxScrapeTimeout
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// PushProx-client and the version it was built as.
+func defaultUserAgent() string {
+	v := version.Version
+	if v == "" {
+		v = "unknown"
+	}
+	return "PushProx-client/" + v
+}
+
+// A transport with the settings of http.DefaultTransport and its own TLS config.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
 	}
-	return timeout
 }
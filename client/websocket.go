@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/net/websocket"
+)
+
+// Sends /push requests over the websocket instead of making them, and
+// everything else, such as the scrapes themselves, through next.
+type wsPushTransport struct {
+	ws      *websocket.Conn
+	pushURL string
+	next    http.RoundTripper
+}
+
+func (t *wsPushTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.String() != t.pushURL {
+		return t.next.RoundTrip(req)
+	}
+	var buf bytes.Buffer
+	err := req.Write(&buf)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Frames are written whole under a lock, so concurrent scrapes can share the connection.
+	if err := websocket.Message.Send(t.ws, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:     "202 Accepted",
+		StatusCode: http.StatusAccepted,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// Like loop, but over a websocket to the proxy's /ws that is kept open for
+// all scrapes. Blocks until the connection breaks.
+// Returns an error if it could not connect and should be retried after backing off.
+func wsLoop(c Coordinator, t target) error {
+	// The headers are the same as for a poll.
+	pollRequest, err := newPollRequest(c.proxyURL, t, *pollTimeout)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Error creating poll request:", "err", err)
+		return err
+	}
+	origin := c.proxyURL
+	location, err := url.Parse(proxyPath("/ws"))
+	if err != nil {
+		return err
+	}
+	location = origin.ResolveReference(location)
+	pushLocation, err := url.Parse(proxyPath("/push"))
+	if err != nil {
+		return err
+	}
+	pushURL := origin.ResolveReference(pushLocation).String()
+	if location.Scheme == "https" {
+		location.Scheme = "wss"
+	} else {
+		location.Scheme = "ws"
+	}
+
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return err
+	}
+	config.Header = pollRequest.Header
+	if tr, ok := transport.(*http.Transport); ok {
+		config.TlsConfig = tr.TLSClientConfig
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Error connecting to /ws:", "err", err)
+		return err
+	}
+	defer ws.Close()
+	if err := websocket.Message.Send(ws, strings.Join(t.keys, "\n")); err != nil {
+		level.Error(c.logger).Log("msg", "Error registering over /ws:", "err", err)
+		return err
+	}
+	level.Info(c.logger).Log("msg", "Connected to proxy over /ws", "url", location.String())
+
+	client := &http.Client{Transport: &wsPushTransport{ws: ws, pushURL: pushURL, next: transport}}
+	if c.cache != nil {
+		go c.flushPushCache(client)
+	}
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			// We were connected, so try again straight away.
+			level.Info(c.logger).Log("msg", "Connection to /ws closed, reconnecting", "err", err)
+			return nil
+		}
+		request, err := readScrapeRequest(bufio.NewReader(bytes.NewReader(msg)))
+		if err != nil {
+			level.Error(c.logger).Log("msg", "Error reading request:", "err", err)
+			continue
+		}
+		level.Info(c.logger).Log("msg", "Got scrape request", "scrape_id", request.Header.Get(util.IDHeader), "url", request.URL)
+
+		request.RequestURI = ""
+
+		request.Host = ""
+
+		go c.doScrape(request, client, t)
+	}
+}
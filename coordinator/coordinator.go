@@ -0,0 +1,905 @@
+// Package coordinator hands scrapes to the clients polling for them and
+// their results back to the scrapes waiting for them. It knows nothing of
+// HTTP routes or flags, see package handlers for how the proxy serves it.
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// The headers proxy and client add between them, which must not reach Prometheus.
+var DefaultStripHeaders = []string{util.IDHeader, "X-Prometheus-Scrape-Timeout-Seconds", "X-Prometheus-Scrape-Timeout", "X-Prom-Pull-Token"}
+
+// How a Coordinator behaves, the proxy fills it in from its flags. The zero
+// value disables every limit, zero durations and a nil StripHeaders get the
+// proxy's defaults.
+type Options struct {
+	// After how long a registration expires, for clients that do not advertise their poll interval.
+	RegistrationTimeout time.Duration
+	// How often clients whose registration expired are forgotten.
+	GCInterval time.Duration
+	// Most scrapes handled at once, any more fail with ErrTooManyScrapes. 0 disables.
+	MaxConcurrentScrapes int
+	// How long a scrape waits for a polling client to pick it up. 0 waits for the whole scrape timeout.
+	EnqueueTimeout time.Duration
+	// Headers removed from scrape results before they are handed back, nil
+	// for DefaultStripHeaders.
+	StripHeaders []string
+	// Fail scrapes of FQDNs no client has registered straight away, instead of waiting for one to show up.
+	RequireKnown bool
+	// Scrapes per second allowed of a single FQDN, and how many more in a burst. 0 disables.
+	FQDNRateLimit float64
+	FQDNRateBurst int
+	// Most client connections waiting for scrapes at once, see PollersFull. 0 disables.
+	PollMaxClients int
+	// Refuse polls for an FQDN that a client with a different instance ID is polling for, instead of only warning.
+	RejectDuplicates bool
+	// Most FQDNs registered at once, including expired ones not yet forgotten. 0 disables.
+	MaxRegistrations int
+	// Most scrapes of one FQDN waiting for its client to poll. 0 allows any number.
+	PendingQueue int
+	// Release a waiting client after this long so it reconnects, possibly to another replica. 0 disables.
+	PollMaxLifetime time.Duration
+	// Which of several client connections polling for the same FQDN gets a
+	// scrape, "round-robin", "random" or "weighted". Empty means round-robin.
+	SelectStrategy string
+	// Timeout of scrapes that don't say, and the most any scrape may have, see ScrapeTimeout.
+	DefaultScrapeTimeout time.Duration
+	MaxScrapeTimeout     time.Duration
+}
+
+// A client connection waiting in WaitForScrapeInstruction.
+type poller struct {
+	// Receives the scrape the poller was picked for. Has room for one, so
+	// handing a scrape over never blocks.
+	ch chan *http.Request
+	// The FQDNs it polls for, it waits in the queue of each.
+	fqdns []string
+	// ClientInfo.Instance and Weight of the client polling.
+	instance string
+	weight   int
+}
+
+// The client connections polling for one FQDN, and the scrapes waiting for one of them.
+type pollQueue struct {
+	// Pollers waiting for a scrape, in the order they started waiting.
+	pollers []*poller
+	// How many scrapes are waiting for a poller.
+	scrapes int
+	// Closed and replaced when a poller joins, to wake the waiting scrapes.
+	joined chan struct{}
+	// Closed and replaced to release the pollers when the FQDN is deregistered.
+	evicted chan struct{}
+	// Credit of each instance for the weighted select strategy, by instance ID.
+	credit map[string]int
+}
+
+// Take p out of the queue, keeping the others in order.
+func (q *pollQueue) remove(p *poller) {
+	for i, other := range q.pollers {
+		if other == p {
+			q.pollers = append(q.pollers[:i], q.pollers[i+1:]...)
+			return
+		}
+	}
+}
+
+// What we know about a registered client.
+type ClientInfo struct {
+	// When it last polled.
+	LastSeen time.Time
+	// ID the client process picked at startup, empty for older clients.
+	Instance string
+	// How often the client says it polls, 0 if it did not say.
+	PollInterval time.Duration
+	// Its share of the scrapes under the weighted select strategy. Less than 1 counts as 1.
+	Weight int
+	// Static labels the client asked to be attached to its targets in /clients.
+	Labels map[string]string
+	// Metadata the client advertised, exposed as __meta_pushprox_<name> labels in /clients.
+	Meta map[string]string
+	// Path of the client's pull URL, exposed as the __metrics_path__ label in /clients.
+	// Empty if the client did not say.
+	MetricsPath string
+	// The IP the client last polled from.
+	SourceIP string
+}
+
+// How long after its last poll the client is forgotten.
+func (c *Coordinator) expiry(info ClientInfo) time.Duration {
+	if info.PollInterval > 0 {
+		return 3 * info.PollInterval
+	}
+	return c.opts.RegistrationTimeout
+}
+
+// Whether the client has polled recently enough to still count as registered.
+func (c *Coordinator) alive(info ClientInfo, now time.Time) bool {
+	return now.Sub(info.LastSeen) < c.expiry(info)
+}
+
+// How often a client that stays connected, rather than polling again after
+// each scrape, has to wait for scrapes anew to remain registered.
+func (c *Coordinator) RefreshInterval(info ClientInfo) time.Duration {
+	if info.PollInterval > 0 {
+		return info.PollInterval
+	}
+	return c.opts.RegistrationTimeout / 2
+}
+
+type Coordinator struct {
+	mu sync.Mutex
+
+	// Clients waiting for a scrape.
+	waiting map[string]*pollQueue
+	// Responses from clients.
+	responses map[string]chan *http.Response
+	// Clients we know about and when they last contacted us.
+	known map[string]ClientInfo
+	// Scrapes in flight that identical scrapes can wait on, by URL.
+	shared map[string]*sharedScrape
+	// When each recent scrape got its result, to recognise pushes the client retried.
+	delivered map[string]time.Time
+	// Signalled when a client registers, changes its labels or source IP, or is forgotten.
+	changes chan struct{}
+
+	// Closed when the proxy starts shutting down.
+	draining  chan struct{}
+	drainOnce sync.Once
+
+	// Scrapes currently in DoScrape.
+	inFlight int64
+	// The same, by FQDN, for /targets.
+	inFlightByFQDN map[string]int
+	// Client connections currently in WaitForScrapeInstruction.
+	pollers int64
+
+	// Limits scrapes per FQDN, nil if FQDNRateLimit is 0.
+	fqdnLimiter *RateLimiter
+	// Picks which poller gets a scrape.
+	selector selectStrategy
+
+	// Unix nanoseconds of the last GC run, to tell if the GC goroutine is alive.
+	lastGC int64
+	// Closed to stop the GC goroutine.
+	stopGC     chan struct{}
+	stopGCOnce sync.Once
+
+	opts   Options
+	logger log.Logger
+}
+
+// Start a Coordinator, along with the goroutine that forgets clients which
+// stopped polling. Call StopGC once it is no longer used.
+func New(logger log.Logger, opts Options) (*Coordinator, error) {
+	selector, ok := selectStrategies[opts.SelectStrategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown select strategy %q", opts.SelectStrategy)
+	}
+	if opts.StripHeaders == nil {
+		opts.StripHeaders = DefaultStripHeaders
+	}
+	if opts.RegistrationTimeout <= 0 {
+		opts.RegistrationTimeout = 5 * time.Minute
+	}
+	if opts.GCInterval <= 0 {
+		opts.GCInterval = time.Minute
+	}
+	if opts.DefaultScrapeTimeout <= 0 {
+		opts.DefaultScrapeTimeout = 15 * time.Second
+	}
+	if opts.MaxScrapeTimeout <= 0 {
+		opts.MaxScrapeTimeout = 5 * time.Minute
+	}
+	c := &Coordinator{
+		waiting:   map[string]*pollQueue{},
+		responses: map[string]chan *http.Response{},
+		known:     map[string]ClientInfo{},
+		shared:    map[string]*sharedScrape{},
+		delivered: map[string]time.Time{},
+		changes:   make(chan struct{}, 1),
+		draining:  make(chan struct{}),
+		selector:  selector,
+		lastGC:    time.Now().UnixNano(),
+		stopGC:    make(chan struct{}),
+		opts:      opts,
+		logger:    logger,
+
+		inFlightByFQDN: map[string]int{},
+	}
+	if opts.FQDNRateLimit > 0 {
+		c.fqdnLimiter = NewRateLimiter(opts.FQDNRateLimit, opts.FQDNRateBurst)
+	}
+	go c.gc()
+	return c, nil
+}
+
+// The timeout of a scrape with header h, see util.ParseScrapeTimeout, with
+// the DefaultScrapeTimeout and MaxScrapeTimeout options.
+func (c *Coordinator) ScrapeTimeout(h http.Header) time.Duration {
+	return util.ParseScrapeTimeout(h.Get("X-Prometheus-Scrape-Timeout-Seconds"), c.opts.DefaultScrapeTimeout, c.opts.MaxScrapeTimeout)
+}
+
+// The key for a host with an optional port, as a client registers it or a
+// scrape asks for it, so both match: lower case, without a trailing dot,
+// IPv6 addresses in brackets, and port 80 if none is given.
+func NormalizeKey(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// No port, or an IPv6 address without brackets.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+	}
+	if port == "" {
+		port = "80"
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return net.JoinHostPort(host, port)
+}
+
+var idCounter int64
+
+// Generate a unique ID
+func genId() string {
+	id := atomic.AddInt64(&idCounter, 1)
+	// TODO: Add MAC address.
+	// TODO: Sign these to prevent spoofing.
+	return fmt.Sprintf("%d-%d-%d", time.Now().Unix(), id, os.Getpid())
+}
+
+// Must be called with the lock held.
+func (c *Coordinator) getPollQueue(fqdn string) *pollQueue {
+	q, ok := c.waiting[fqdn]
+	if !ok {
+		q = &pollQueue{joined: make(chan struct{}), evicted: make(chan struct{})}
+		c.waiting[fqdn] = q
+	}
+	return q
+}
+
+// Forget the queue for fqdn once neither pollers nor scrapes wait in it.
+// Must be called with the lock held.
+func (c *Coordinator) releasePollQueue(fqdn string, q *pollQueue) {
+	if len(q.pollers) == 0 && q.scrapes == 0 {
+		delete(c.waiting, fqdn)
+	}
+}
+
+// Put p in the queue of each of its FQDNs, waking scrapes waiting for them.
+// Returns the channels closed if each FQDN is deregistered, in the same order.
+func (c *Coordinator) addPoller(p *poller) []chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := make([]chan struct{}, 0, len(p.fqdns))
+	for _, fqdn := range p.fqdns {
+		q := c.getPollQueue(fqdn)
+		q.pollers = append(q.pollers, p)
+		close(q.joined)
+		q.joined = make(chan struct{})
+		evicted = append(evicted, q.evicted)
+	}
+	return evicted
+}
+
+// Take p out of all its queues. Must be called with the lock held.
+func (c *Coordinator) dequeuePoller(p *poller) {
+	for _, fqdn := range p.fqdns {
+		if q, ok := c.waiting[fqdn]; ok {
+			q.remove(p)
+			c.releasePollQueue(fqdn, q)
+		}
+	}
+}
+
+// Unregister a client connection that stops waiting. Returns the scrape it
+// was handed in the meantime, if any.
+func (c *Coordinator) removePoller(p *poller) *http.Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dequeuePoller(p)
+	select {
+	case request := <-p.ch:
+		return request
+	default:
+		return nil
+	}
+}
+
+// Hand r to one of the pollers waiting for fqdn, picked by the SelectStrategy option.
+// If there is none, r is counted as waiting and a channel closed once a poller
+// joins is returned. Call stopWaiting before trying again or giving up.
+// ErrPendingQueueFull is returned instead if limit scrapes are already waiting, 0 means no limit.
+func (c *Coordinator) dispatch(fqdn string, r *http.Request, limit int) (<-chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q := c.getPollQueue(fqdn)
+	if len(q.pollers) == 0 {
+		if limit > 0 && q.scrapes >= limit {
+			return nil, ErrPendingQueueFull
+		}
+		q.scrapes++
+		return q.joined, nil
+	}
+	p := q.pollers[c.selector.pick(q)]
+	level.Debug(c.logger).Log("msg", "Picked poller for scrape", "fqdn", fqdn, "instance_id", p.instance)
+	// It returns with this scrape, so no other scrape may pick it.
+	c.dequeuePoller(p)
+	p.ch <- r
+	return nil, nil
+}
+
+// Undo the waiting count of a dispatch that found no poller.
+func (c *Coordinator) stopWaiting(fqdn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if q, ok := c.waiting[fqdn]; ok {
+		q.scrapes--
+		c.releasePollQueue(fqdn, q)
+	}
+}
+
+// Forget the client registered for fqdn and release its waiting polls.
+// Returns false if no client was registered or polling for it.
+func (c *Coordinator) Deregister(fqdn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, known := c.known[fqdn]
+	delete(c.known, fqdn)
+	q, ok := c.waiting[fqdn]
+	polling := ok && len(q.pollers) > 0
+	if polling {
+		// The pollers take themselves out of the queue, scrapes waiting in it go to whoever polls next.
+		close(q.evicted)
+		q.evicted = make(chan struct{})
+	}
+	if known || polling {
+		c.notifyChange()
+		level.Info(c.logger).Log("msg", "Deregistered client", "fqdn", fqdn)
+	}
+	return known || polling
+}
+
+// Register a scrape as waiting for its result. Buffered, so that
+// ScrapeResult never blocks on a scrape that is about to give up.
+func (c *Coordinator) addResponseChannel(id string) chan *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan *http.Response, 1)
+	c.responses[id] = ch
+	return ch
+}
+
+// Deregister a scrape. Once this returns ScrapeResult can no longer
+// deliver to it, so a result that slipped in is closed here.
+func (c *Coordinator) removeResponseChannel(id string) {
+	c.mu.Lock()
+	ch := c.responses[id]
+	delete(c.responses, id)
+	c.mu.Unlock()
+	select {
+	case resp := <-ch:
+		orphanedResults.WithLabelValues("late").Inc()
+		resp.Body.Close()
+	default:
+	}
+}
+
+// Returned by ScrapeResult when the scrape a pushed result belongs to is no longer waiting for it.
+var ErrUnknownScrape = errors.New("no scrape is waiting for this id")
+
+// Returned by ScrapeResult when a result for this scrape was already pushed,
+// usually because the client retried a push that got through.
+var ErrDuplicateResult = errors.New("a result for this id was already pushed")
+
+// Returned by DoScrape when MaxConcurrentScrapes scrapes are already in flight.
+var ErrTooManyScrapes = errors.New("too many concurrent scrapes")
+
+// Returned by DoScrape when PendingQueue scrapes already wait for the FQDN's client to poll.
+var ErrPendingQueueFull = errors.New("too many scrapes waiting for the client to poll")
+
+// Returned by DoScrape when a client picked up the scrape but did not push the result in time.
+var ErrScrapeTimeout = errors.New("timed out waiting for the client to push the scrape result")
+
+// Returned by DoScrape when the FQDN was scraped more often than FQDNRateLimit allows.
+var ErrRateLimited = errors.New("scrape rate limit for this FQDN exceeded")
+
+// Returned by DoScrape for scrapes no client had picked up yet when Drain was called.
+var ErrDraining = errors.New("proxy is shutting down")
+
+// Why a scrape fails with RequireKnown.
+var ErrUnknownClient = errors.New("no client has registered for it")
+
+// Returned by DoScrape when no client picked up the scrape in time.
+type NoClientError struct {
+	url string
+	err error
+}
+
+func (e NoClientError) Error() string {
+	return fmt.Sprintf("Matching client not found for %q: %s", e.url, e.err)
+}
+
+// Request a scrape.
+// needs a context carrying the scrape deadline, derived from the incoming request's context
+// so that it is cancelled when the requester goes away, and the request.
+// returns the response from the scrape or nil, an error or nil, and true if the client disconnected.
+// Returns the ID the scrape was sent to the client with, empty if it never got
+// that far. r is not changed, it may be read again while a client still writes
+// out the scrape it was handed.
+func (c *Coordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Response, string, error, bool) {
+	// bound the goroutines and channels a burst of scrapes can create.
+	inFlight := atomic.AddInt64(&c.inFlight, 1)
+	defer atomic.AddInt64(&c.inFlight, -1)
+	if c.opts.MaxConcurrentScrapes > 0 && inFlight > int64(c.opts.MaxConcurrentScrapes) {
+		return nil, "", ErrTooManyScrapes, false
+	}
+	scrapesInFlight.Inc()
+	defer scrapesInFlight.Dec()
+	id := genId()
+	level.Info(c.logger).Log("msg", "DoScrape", "scrape_id", id, "url", r.URL.String())
+	r = r.WithContext(r.Context())
+	r.Header = util.CloneHeader(r.Header)
+	r.Header.Set(util.IDHeader, id)
+	// register for the result before the client can see the request, so a fast push
+	// finds us, and deregister however we leave, so a late push is dropped.
+	respCh := c.addResponseChannel(id)
+	defer c.removeResponseChannel(id)
+	// send the request out to the client to request a scape, by getting the request channel
+	// and sending it.
+	// if the client is not connected, then this will block until it is connected.
+	// the server doing the scrape could disconnect before the requestChannel becomes available
+	// that would leave the sockets in an ugly state and should be handled
+	// the key is the FQDN and the port, 
+	// only wait EnqueueTimeout for a client to pick the request up so
+	// Prometheus hears about missing clients quickly.
+	key := NormalizeKey(r.URL.Host)
+	c.trackInFlight(key, 1)
+	defer c.trackInFlight(key, -1)
+	if c.opts.RequireKnown && !c.isKnown(key) {
+		return nil, "", NoClientError{url: r.URL.String(), err: ErrUnknownClient}, false
+	}
+	if c.fqdnLimiter != nil && !c.fqdnLimiter.Allow(key) {
+		return nil, "", ErrRateLimited, false
+	}
+	enqueueCtx := ctx
+	if c.opts.EnqueueTimeout > 0 {
+		var cancel context.CancelFunc
+		enqueueCtx, cancel = context.WithTimeout(ctx, c.opts.EnqueueTimeout)
+		defer cancel()
+	}
+	// Scrapes already waiting keep their place when a poller joins and
+	// they try again, only new ones are held to PendingQueue.
+	limit := c.opts.PendingQueue
+	for {
+		// Clients are no longer handed scrapes.
+		if c.Draining() {
+			return nil, "", ErrDraining, false
+		}
+		joined, err := c.dispatch(key, r, limit)
+		if err != nil {
+			return nil, "", err, false
+		}
+		if joined == nil {
+			break
+		}
+		limit = 0
+		select {
+		case <-enqueueCtx.Done():
+			c.stopWaiting(key)
+			if enqueueCtx.Err() == context.Canceled {
+				level.Info(c.logger).Log("msg", "DoScrape: client closed", "scrape_id", id)
+				return nil, "", nil, true
+			}
+			return nil, "", NoClientError{url: r.URL.String(), err: enqueueCtx.Err()}, false
+		case <-joined:
+			c.stopWaiting(key)
+		case <-c.draining:
+			c.stopWaiting(key)
+			return nil, "", ErrDraining, false
+		}
+	}
+
+	// the server requesting the scrape could disconnect here so must handle that
+	// while waiting for data to come in on the response channel.
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			level.Info(c.logger).Log("msg", "DoScrape: client closed", "scrape_id", id)
+			return nil, id, nil, true
+		}
+		level.Debug(c.logger).Log("msg", "DoScrape: timed out", "scrape_id", id)
+		return nil, id, ErrScrapeTimeout, false
+	case resp := <-respCh:
+		level.Debug(c.logger).Log("msg", "DoScrape: response ok", "scrape_id", id)
+		return resp, id, nil, false
+	}
+}
+
+// Client registering to accept a scrape request for any of fqdns. Blocking.
+// ctx is the poll request's context, cancelled when the client disconnects.
+// info is what the client told us about itself. Once refresh fires the wait
+// ends without a scrape while the client stays connected, nil never fires.
+func (c *Coordinator) WaitForScrapeInstruction(ctx context.Context, fqdns []string, info ClientInfo, refresh <-chan time.Time) (*http.Request, bool) {
+	atomic.AddInt64(&c.pollers, 1)
+	defer atomic.AddInt64(&c.pollers, -1)
+
+	// recycle long lived polls so clients rebalance across replicas behind a load balancer.
+	var expired <-chan time.Time
+	if c.opts.PollMaxLifetime > 0 {
+		timer := time.NewTimer(c.opts.PollMaxLifetime)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for _, fqdn := range fqdns {
+		c.addKnownClient(fqdn, info)
+	}
+	weight := info.Weight
+	if weight < 1 {
+		weight = 1
+	}
+	p := &poller{ch: make(chan *http.Request, 1), fqdns: fqdns, instance: info.Instance, weight: weight}
+	// the connection can poll for several fqdns, so their evictions
+	// are selected on dynamically after these fixed cases.
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.draining)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(expired)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(p.ch)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(refresh)},
+	}
+	const fixedCases = 5
+	names := strings.Join(fqdns, ",")
+	for {
+		// Queued again after each scrape that timed out before we got it,
+		// with the eviction channels as they are now.
+		cases = cases[:fixedCases]
+		for _, evicted := range c.addPoller(p) {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(evicted)})
+		}
+		chosen, value, _ := reflect.Select(cases)
+		if chosen != 3 {
+			// A scrape may have been handed over just as we gave up. The
+			// connection can still take it unless the client is gone.
+			if request := c.removePoller(p); request != nil {
+				if ctx.Err() == nil {
+					level.Debug(c.logger).Log("msg", "WaitForScrapeInstruction: ok waiting for scrape", "fqdn", names)
+					return request, true
+				}
+				level.Info(c.logger).Log("msg", "WaitForScrapeInstruction: client closed while processing scrape (rare)", "fqdn", names)
+			}
+		}
+		switch chosen {
+		case 0:
+			level.Info(c.logger).Log("msg", "WaitForScrapeInstruction: client closed", "fqdn", names)
+
+			return nil, false
+		case 1:
+			level.Info(c.logger).Log("msg", "WaitForScrapeInstruction: proxy draining, releasing client", "fqdn", names)
+			return nil, false
+		case 2:
+			level.Debug(c.logger).Log("msg", "WaitForScrapeInstruction: poll max lifetime reached, releasing client", "fqdn", names)
+			return nil, false
+		case 4:
+			return nil, false
+		}
+		if chosen >= fixedCases {
+			level.Info(c.logger).Log("msg", "WaitForScrapeInstruction: client deregistered, releasing client", "fqdn", fqdns[chosen-fixedCases])
+			return nil, false
+		}
+		request := value.Interface().(*http.Request)
+		fqdn := NormalizeKey(request.URL.Host)
+		if ctx.Err() != nil {
+			level.Info(c.logger).Log("msg", "WaitForScrapeInstruction: client closed while processing scrape (rare)", "fqdn", fqdn)
+			return nil, false
+		}
+		if request.Context().Err() != nil {
+			// Nobody waits for its result any more, so wait for another one instead.
+			level.Info(c.logger).Log("msg", "WaitForScrapeInstruction: timeout waiting for scrape", "fqdn", fqdn)
+			continue
+		}
+		level.Debug(c.logger).Log("msg", "WaitForScrapeInstruction: ok waiting for scrape", "fqdn", fqdn)
+		return request, true
+	}
+}
+
+// Fail the scrape with the given id, if it still waits, with a result
+// carrying status, the scrape error class and msg, as if the client had pushed it.
+func (c *Coordinator) FailScrape(id string, status int, class, msg string) {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(msg)),
+	}
+	resp.Header.Set(util.IDHeader, id)
+	resp.Header.Set(util.ScrapeErrorHeader, class)
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if err := c.ScrapeResult(resp); err != nil {
+		level.Debug(c.logger).Log("msg", "Could not fail scrape", "scrape_id", id, "err", err)
+	}
+}
+
+// Client sending a scrape result in.
+// this is super confusing.
+// the Response is the response is a pre-prepared response generated 
+// from the body of the request that came in from the client
+// that body contains all the headers of the response in the body.
+// When a response channel is available, the preformed response is sent 
+// directly to the channel which returns to the 
+func (c *Coordinator) ScrapeResult(r *http.Response) error {
+	id := r.Header.Get(util.IDHeader)
+	level.Info(c.logger).Log("msg", "ScrapeResult", "scrape_id", id)
+	// Don't expose internal headers.
+	for _, h := range c.opts.StripHeaders {
+		r.Header.Del(h)
+	}
+	// Hand the result over under the lock, so DoScrape can't give up in between
+	// and leave it in a channel nobody reads. The channel has room for exactly
+	// one result, so this never blocks.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.delivered[id]; ok {
+		orphanedResults.WithLabelValues("duplicate").Inc()
+		return ErrDuplicateResult
+	}
+	ch, ok := c.responses[id]
+	if !ok {
+		// Prometheus disconnected or timed out, nobody is waiting for this.
+		level.Debug(c.logger).Log("msg", "ScrapeResult: no scrape waiting", "scrape_id", id)
+		orphanedResults.WithLabelValues("unknown").Inc()
+		return ErrUnknownScrape
+	}
+	select {
+	case ch <- r:
+		level.Debug(c.logger).Log("msg", "ScrapeResult: sent to response channel", "scrape_id", id)
+		c.delivered[id] = time.Now()
+		return nil
+	default:
+		orphanedResults.WithLabelValues("duplicate").Inc()
+		return ErrDuplicateResult
+	}
+}
+
+// Stop handing out scrapes to clients and release the ones currently waiting. Idempotent.
+func (c *Coordinator) Drain() {
+	c.drainOnce.Do(func() { close(c.draining) })
+}
+
+// Wait until no scrape is in flight, so after Drain those already handed to a
+// client can still have their result pushed. Returns ctx.Err() if ctx ends first.
+func (c *Coordinator) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&c.inFlight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Whether Drain has been called.
+func (c *Coordinator) Draining() bool {
+	select {
+	case <-c.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sizes of the waiting, responses and known maps.
+func (c *Coordinator) sizes() (int, int, int, int64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := 0
+	for _, q := range c.waiting {
+		pending += q.scrapes
+	}
+	return len(c.waiting), len(c.responses), len(c.known), atomic.LoadInt64(&c.pollers), pending
+}
+
+// Whether PollMaxClients client connections are already waiting for scrapes.
+func (c *Coordinator) PollersFull() bool {
+	return c.opts.PollMaxClients > 0 && atomic.LoadInt64(&c.pollers) >= int64(c.opts.PollMaxClients)
+}
+
+// Whether the background goroutines are still running. Cheap enough for frequent probes.
+func (c *Coordinator) Healthy() bool {
+	last := time.Unix(0, atomic.LoadInt64(&c.lastGC))
+	// allow a couple of missed GC runs before giving up on it.
+	return time.Since(last) < 3*c.opts.GCInterval
+}
+
+func (c *Coordinator) addKnownClient(fqdn string, info ClientInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info.LastSeen = time.Now()
+	old, ok := c.known[fqdn]
+	c.known[fqdn] = info
+	if !ok || !c.alive(old, info.LastSeen) || !reflect.DeepEqual(old.Labels, info.Labels) || !reflect.DeepEqual(old.Meta, info.Meta) || old.SourceIP != info.SourceIP {
+		c.notifyChange()
+	}
+}
+
+// Signal a change to the known clients without blocking, one pending signal covers any number of changes.
+// Must be called with the lock held.
+func (c *Coordinator) notifyChange() {
+	select {
+	case c.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Receives after the set of known clients or their labels changed.
+func (c *Coordinator) Changes() <-chan struct{} {
+	return c.changes
+}
+
+// Returned by CheckRegistration when another client process holds one of the FQDNs.
+var ErrDuplicateRegistration = errors.New("FQDN is already registered by another client")
+
+// Returned by CheckRegistration when registering the FQDNs would exceed MaxRegistrations.
+var ErrTooManyRegistrations = errors.New("too many FQDNs registered")
+
+// Look for another client process polling for any of fqdns, which would get
+// some of the scrapes meant for this one. Only clients that send an instance
+// ID can be told apart, for older ones a second poller is only logged.
+// Returns ErrDuplicateRegistration with RejectDuplicates.
+// Also returns ErrTooManyRegistrations if the FQDNs not registered yet don't
+// fit under MaxRegistrations.
+func (c *Coordinator) CheckRegistration(fqdns []string, info ClientInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.MaxRegistrations > 0 {
+		added := 0
+		for _, fqdn := range fqdns {
+			if _, ok := c.known[fqdn]; !ok {
+				added++
+			}
+		}
+		if added > 0 && len(c.known)+added > c.opts.MaxRegistrations {
+			registrationsRejected.Inc()
+			level.Warn(c.logger).Log("msg", "Too many FQDNs registered, refusing poll", "fqdn", strings.Join(fqdns, ","), "source_ip", info.SourceIP, "registered", len(c.known), "max", c.opts.MaxRegistrations)
+			return ErrTooManyRegistrations
+		}
+	}
+	now := time.Now()
+	for _, fqdn := range fqdns {
+		q, ok := c.waiting[fqdn]
+		if !ok || len(q.pollers) == 0 {
+			continue
+		}
+		held, ok := c.known[fqdn]
+		if !ok || !c.alive(held, now) || held.Instance == info.Instance && info.Instance != "" {
+			continue
+		}
+		duplicateRegistrations.Inc()
+		level.Warn(c.logger).Log("msg", "FQDN registered by more than one client, scrapes will go to either", "fqdn", fqdn, "instance_id", info.Instance, "source_ip", info.SourceIP, "other_instance_id", held.Instance, "other_source_ip", held.SourceIP)
+		if c.opts.RejectDuplicates && info.Instance != "" && held.Instance != "" {
+			return ErrDuplicateRegistration
+		}
+	}
+	return nil
+}
+
+// Whether a live client has registered for fqdn.
+func (c *Coordinator) isKnown(fqdn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, ok := c.known[fqdn]
+	return ok && c.alive(info, time.Now())
+}
+
+// What clients are alive.
+func (c *Coordinator) KnownClients() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	known := make([]string, 0, len(c.known))
+	for k, info := range c.known {
+		if c.alive(info, now) {
+			known = append(known, k)
+		}
+	}
+	return known
+}
+
+// What clients are alive, and what we know about them.
+func (c *Coordinator) KnownClientsDetailed() map[string]ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	known := make(map[string]ClientInfo, len(c.known))
+	for k, info := range c.known {
+		if c.alive(info, now) {
+			known[k] = info
+		}
+	}
+	return known
+}
+
+func (c *Coordinator) trackInFlight(fqdn string, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.inFlightByFQDN[fqdn] + delta; n > 0 {
+		c.inFlightByFQDN[fqdn] = n
+	} else {
+		delete(c.inFlightByFQDN, fqdn)
+	}
+}
+
+// How many scrapes are in DoScrape for each FQDN that has any.
+func (c *Coordinator) InFlightByFQDN() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inFlight := make(map[string]int, len(c.inFlightByFQDN))
+	for k, n := range c.inFlightByFQDN {
+		inFlight[k] = n
+	}
+	return inFlight
+}
+
+// Stop the GC goroutine, for when the proxy shuts down.
+func (c *Coordinator) StopGC() {
+	c.stopGCOnce.Do(func() { close(c.stopGC) })
+}
+
+// Garbagee collect old clients.
+func (c *Coordinator) gc() {
+	ticker := time.NewTicker(c.opts.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopGC:
+			return
+		case <-ticker.C:
+		}
+		func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			now := time.Now()
+			deleted := 0
+			for k, info := range c.known {
+				if !c.alive(info, now) {
+					delete(c.known, k)
+					if c.fqdnLimiter != nil {
+						c.fqdnLimiter.Forget(k)
+					}
+					deleted++
+				}
+			}
+			if deleted > 0 {
+				c.notifyChange()
+			}
+			// Clients stop retrying a push once its scrape timed out.
+			for id, t := range c.delivered {
+				if now.Sub(t) > c.opts.MaxScrapeTimeout {
+					delete(c.delivered, id)
+				}
+			}
+			level.Info(c.logger).Log("msg", "GC of clients completed", "deleted", deleted, "remaining", len(c.known))
+			atomic.StoreInt64(&c.lastGC, time.Now().UnixNano())
+		}()
+	}
+}
@@ -0,0 +1,396 @@
+package coordinator
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log"
+)
+
+// A Coordinator with opts, stop it with StopGC.
+func newTestCoordinator(opts Options) *Coordinator {
+	c, err := New(log.NewNopLogger(), opts)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func TestDoScrapeLeavesRequestAlone(t *testing.T) {
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	req, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	handed := make(chan *http.Request, 1)
+	go func() {
+		r, _ := c.WaitForScrapeInstruction(context.Background(), []string{"host:9100"}, ClientInfo{}, nil)
+		handed <- r
+	}()
+	_, id, err, _ := c.DoScrape(ctx, req)
+	if err != ErrScrapeTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrScrapeTimeout)
+	}
+	if id == "" {
+		t.Fatal("no scrape ID returned")
+	}
+	if got := req.Header.Get(util.IDHeader); got != "" {
+		t.Errorf("request got ID %q", got)
+	}
+	handedReq := <-handed
+	if got := handedReq.Header.Get(util.IDHeader); got != id {
+		t.Errorf("client got ID %q, want %q", got, id)
+	}
+
+	// A slow client still writes out the scrape while it is retried, which
+	// the race detector catches if either changes the other's headers.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < 100; i++ {
+			handedReq.Write(ioutil.Discard)
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.DoScrape(ctx, req.WithContext(ctx))
+	req.Header.Get(util.IDHeader)
+	<-written
+}
+
+// Wait until a poller for fqdn is queued.
+func waitForPoller(c *Coordinator, fqdn string) {
+	for {
+		c.mu.Lock()
+		q, ok := c.waiting[fqdn]
+		n := 0
+		if ok {
+			n = len(q.pollers)
+		}
+		c.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitForScrapeInstructionRefreshKeepsScrape(t *testing.T) {
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	req, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+
+	// Hand a scrape over just as the wait is refreshed, whichever of the two
+	// it sees first the scrape must not be lost.
+	for i := 0; i < 100; i++ {
+		refresh := make(chan time.Time, 1)
+		got := make(chan *http.Request, 1)
+		go func() {
+			r, _ := c.WaitForScrapeInstruction(context.Background(), []string{"host:9100"}, ClientInfo{}, refresh)
+			got <- r
+		}()
+		waitForPoller(c, "host:9100")
+		refresh <- time.Now()
+		joined, err := c.dispatch("host:9100", req, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := <-got
+		if joined != nil {
+			// The poller was already gone.
+			c.stopWaiting("host:9100")
+			continue
+		}
+		if r != req {
+			t.Fatalf("scrape handed over at refresh %d was dropped", i)
+		}
+	}
+}
+
+func TestDisconnectedScrapesDoNotLeak(t *testing.T) {
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool)
+		go func() {
+			_, _, _, disconnect := c.DoScrape(ctx, req.WithContext(ctx))
+			done <- disconnect
+		}()
+		if i%2 == 0 {
+			// Prometheus goes away before any client polls.
+			cancel()
+			if !<-done {
+				t.Fatal("scrape cancelled while waiting for a client not reported as a disconnect")
+			}
+			continue
+		}
+		// Prometheus goes away after a client picked the scrape up, whose
+		// result then has nowhere to go.
+		handed, _ := c.WaitForScrapeInstruction(context.Background(), []string{"host:9100"}, ClientInfo{}, nil)
+		cancel()
+		if !<-done {
+			t.Fatal("scrape cancelled while waiting for its result not reported as a disconnect")
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("up 1\n"))}
+		resp.Header.Set(util.IDHeader, handed.Header.Get(util.IDHeader))
+		if err := c.ScrapeResult(resp); err != ErrUnknownScrape {
+			t.Fatalf("result for an abandoned scrape got %v, want %v", err, ErrUnknownScrape)
+		}
+	}
+
+	if waiting, responses, _, pollers, pending := c.sizes(); waiting != 0 || responses != 0 || pollers != 0 || pending != 0 {
+		t.Errorf("left behind %d waiting FQDNs, %d response channels, %d pollers, %d pending scrapes", waiting, responses, pollers, pending)
+	}
+	// Goroutines of the cancelled contexts may take a moment to exit.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before the scrapes, %d after", before, after)
+	}
+}
+
+func TestScrapeResultBeforeReceive(t *testing.T) {
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	ch := c.addResponseChannel("1")
+	defer c.removeResponseChannel("1")
+
+	// Nobody receives yet, the result must still be taken without blocking.
+	result := func() *http.Response {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("up 1\n"))}
+		resp.Header.Set(util.IDHeader, "1")
+		return resp
+	}
+	first := result()
+	if err := c.ScrapeResult(first); err != nil {
+		t.Fatalf("got %v, want the result taken", err)
+	}
+	if err := c.ScrapeResult(result()); err != ErrDuplicateResult {
+		t.Errorf("second result got %v, want %v", err, ErrDuplicateResult)
+	}
+	if got := <-ch; got != first {
+		t.Error("the first result was not delivered")
+	}
+}
+
+func TestGCInterval(t *testing.T) {
+	c := newTestCoordinator(Options{RegistrationTimeout: 20 * time.Millisecond, GCInterval: 10 * time.Millisecond})
+	defer c.StopGC()
+	known := func() int {
+		_, _, n, _, _ := c.sizes()
+		return n
+	}
+	register := func(fqdn string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c.WaitForScrapeInstruction(ctx, []string{fqdn}, ClientInfo{}, nil)
+	}
+
+	register("host:9100")
+	if known() != 1 {
+		t.Fatal("client not registered")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for known() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if known() != 0 {
+		t.Fatal("stale client not collected")
+	}
+	if !c.Healthy() {
+		t.Error("unhealthy while the GC runs")
+	}
+
+	// Once stopped nothing is collected any more.
+	c.StopGC()
+	time.Sleep(20 * time.Millisecond)
+	register("host:9100")
+	time.Sleep(100 * time.Millisecond)
+	if known() != 1 {
+		t.Error("client collected after the GC was stopped")
+	}
+	if c.Healthy() {
+		t.Error("healthy with the GC stopped")
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	header := func(v string) http.Header {
+		h := http.Header{}
+		if v != "" {
+			h.Set("X-Prometheus-Scrape-Timeout-Seconds", v)
+		}
+		return h
+	}
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	for v, want := range map[string]time.Duration{"": 15 * time.Second, "garbage": 15 * time.Second, "-1": 15 * time.Second, "3": 3 * time.Second, "1e9": 5 * time.Minute} {
+		if got := c.ScrapeTimeout(header(v)); got != want {
+			t.Errorf("default options, %q: got %v, want %v", v, got, want)
+		}
+	}
+
+	c = newTestCoordinator(Options{DefaultScrapeTimeout: 10 * time.Second, MaxScrapeTimeout: 30 * time.Second})
+	defer c.StopGC()
+	for v, want := range map[string]time.Duration{"": 10 * time.Second, "0": 10 * time.Second, "20": 20 * time.Second, "60": 30 * time.Second} {
+		if got := c.ScrapeTimeout(header(v)); got != want {
+			t.Errorf("%q: got %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"host.example:9100":   "host.example:9100",
+		"Host.Example:9100":   "host.example:9100",
+		"host.example.:9100":  "host.example:9100",
+		"HOST.example.":       "host.example:80",
+		"host.example":        "host.example:80",
+		"10.0.0.1":            "10.0.0.1:80",
+		"10.0.0.1:9100":       "10.0.0.1:9100",
+		"[2001:db8::1]:9100":  "[2001:db8::1]:9100",
+		"[2001:DB8::1]:9100":  "[2001:db8::1]:9100",
+		"[2001:db8::1]":       "[2001:db8::1]:80",
+		"2001:db8::1":         "[2001:db8::1]:80",
+		"[fe80::1%eth0]:9100": "[fe80::1%eth0]:9100",
+	} {
+		if got := NormalizeKey(in); got != want {
+			t.Errorf("NormalizeKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestScrapeMatching(t *testing.T) {
+	for name, c := range map[string]struct {
+		opts Options
+		// What the client polls for, none if empty.
+		polls []string
+		// Whether the client pushes a result for the scrape it gets.
+		pushes bool
+		// Whether Prometheus gives up on the scrape before the timeout.
+		cancel         bool
+		wantStatus     int
+		wantErr        error
+		wantNoClient   bool
+		wantDisconnect bool
+	}{
+		"match":          {polls: []string{"host:9100"}, pushes: true, wantStatus: http.StatusOK},
+		"one of several": {polls: []string{"other:9100", "host:9100"}, pushes: true, wantStatus: http.StatusOK},
+		"other client":   {opts: Options{EnqueueTimeout: 10 * time.Millisecond}, polls: []string{"other:9100"}, wantNoClient: true},
+		"no client":      {opts: Options{EnqueueTimeout: 10 * time.Millisecond}, wantNoClient: true},
+		"not known":      {opts: Options{RequireKnown: true}, wantNoClient: true},
+		"no result":      {polls: []string{"host:9100"}, wantErr: ErrScrapeTimeout},
+		"requester gone": {polls: []string{"other:9100"}, cancel: true, wantDisconnect: true},
+	} {
+		co := newTestCoordinator(c.opts)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		pollCtx, stopPoll := context.WithCancel(context.Background())
+		polled := make(chan struct{})
+		go func() {
+			defer close(polled)
+			if len(c.polls) == 0 {
+				return
+			}
+			req, ok := co.WaitForScrapeInstruction(pollCtx, c.polls, ClientInfo{}, nil)
+			if !ok || !c.pushes {
+				return
+			}
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("up 1\n"))}
+			resp.Header.Set(util.IDHeader, req.Header.Get(util.IDHeader))
+			co.ScrapeResult(resp)
+		}()
+		if c.cancel {
+			time.AfterFunc(10*time.Millisecond, cancel)
+		}
+
+		req, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+		resp, _, err, disconnect := co.DoScrape(ctx, req.WithContext(ctx))
+		cancel()
+		stopPoll()
+		<-polled
+		co.StopGC()
+
+		if disconnect != c.wantDisconnect {
+			t.Errorf("%s: got disconnect %v, want %v", name, disconnect, c.wantDisconnect)
+		}
+		if _, noClient := err.(NoClientError); noClient != c.wantNoClient {
+			t.Errorf("%s: got error %v, want a NoClientError: %v", name, err, c.wantNoClient)
+		} else if !noClient && err != c.wantErr {
+			t.Errorf("%s: got error %v, want %v", name, err, c.wantErr)
+		}
+		if resp != nil {
+			resp.Body.Close()
+			if resp.StatusCode != c.wantStatus {
+				t.Errorf("%s: got status %d, want %d", name, resp.StatusCode, c.wantStatus)
+			}
+		} else if c.wantStatus != 0 {
+			t.Errorf("%s: got no result, want %d", name, c.wantStatus)
+		}
+	}
+}
+
+func TestWaitForScrapeInstructionSkipsCancelledScrape(t *testing.T) {
+	var skipped int32
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			if keyvals[i] == "msg" && keyvals[i+1] == "WaitForScrapeInstruction: timeout waiting for scrape" {
+				atomic.AddInt32(&skipped, 1)
+			}
+		}
+		return nil
+	})
+	c, err := New(logger, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopGC()
+
+	got := make(chan *http.Request, 1)
+	go func() {
+		r, _ := c.WaitForScrapeInstruction(context.Background(), []string{"host:9100"}, ClientInfo{}, nil)
+		got <- r
+	}()
+	waitForPoller(c, "host:9100")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	if joined, err := c.dispatch("host:9100", cancelled.WithContext(ctx), 0); err != nil || joined != nil {
+		t.Fatalf("cancelled scrape not handed to the poller: %v", err)
+	}
+
+	// The poller drops it and waits for the next scrape, without going round
+	// and round in the meantime.
+	waitForPoller(c, "host:9100")
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&skipped); n != 1 {
+		t.Errorf("cancelled scrape skipped %d times, want once", n)
+	}
+	select {
+	case r := <-got:
+		t.Fatalf("poller returned %v for a cancelled scrape", r)
+	default:
+	}
+
+	live, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	if joined, err := c.dispatch("host:9100", live, 0); err != nil || joined != nil {
+		t.Fatalf("scrape not handed to the poller: %v", err)
+	}
+	if r := <-got; r != live {
+		t.Errorf("poller returned %v, want the live scrape", r)
+	}
+}
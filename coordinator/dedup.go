@@ -0,0 +1,116 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// A scrape that several identical requests wait on, see DoScrapeShared.
+type sharedScrape struct {
+	// Closed once resp, body and err are set.
+	done chan struct{}
+	resp *http.Response
+	body []byte
+	err  error
+	// ID of the scrape sent to the client, empty if it never got that far.
+	id string
+
+	// Requests still waiting, guarded by the coordinator's mutex.
+	waiters int
+	// Gives up on the scrape once nobody waits for it anymore.
+	cancel context.CancelFunc
+}
+
+// Like DoScrape, but if a scrape of the same URL with the same headers is
+// already in flight wait for its result instead of asking the client again.
+// Requests only differing in, say, Accept or Authorization get scrapes of their
+// own. The shared scrape goes on while any request still waits for it, so one
+// that joins with a later deadline is not cut short by the first.
+func (c *Coordinator) DoScrapeShared(ctx context.Context, r *http.Request) (*http.Response, string, error, bool) {
+	key := sharedScrapeKey(r)
+	c.mu.Lock()
+	s, ok := c.shared[key]
+	if !ok {
+		// Not tied to any one request, the last one to leave cancels it.
+		scrapeCtx, cancel := context.WithCancel(context.Background())
+		s = &sharedScrape{done: make(chan struct{}), cancel: cancel}
+		c.shared[key] = s
+		go c.runSharedScrape(scrapeCtx, key, s, r.WithContext(scrapeCtx))
+	} else {
+		level.Debug(c.logger).Log("msg", "DoScrapeShared: joining scrape in flight", "url", r.URL.String())
+	}
+	s.waiters++
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		s.waiters--
+		if s.waiters == 0 {
+			s.cancel()
+			// Later requests must not join the cancelled scrape.
+			if c.shared[key] == s {
+				delete(c.shared, key)
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			level.Info(c.logger).Log("msg", "DoScrapeShared: client closed", "url", r.URL.String())
+			return nil, "", nil, true
+		}
+		return nil, "", ErrScrapeTimeout, false
+	case <-s.done:
+	}
+	if s.err != nil {
+		return nil, s.id, s.err, false
+	}
+	// Every waiter gets its own copy to write out.
+	resp := *s.resp
+	resp.Header = http.Header{}
+	for k, v := range s.resp.Header {
+		resp.Header[k] = v
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(s.body))
+	return &resp, s.id, nil, false
+}
+
+// Requests are only shared if they have the same URL and headers.
+func sharedScrapeKey(r *http.Request) string {
+	var b bytes.Buffer
+	b.WriteString(r.URL.String())
+	b.WriteString("\n")
+	// Written sorted by name.
+	r.Header.Write(&b)
+	return b.String()
+}
+
+// Do the scrape for s and hand the result to its waiters.
+func (c *Coordinator) runSharedScrape(ctx context.Context, key string, s *sharedScrape, r *http.Request) {
+	resp, id, err, disconnect := c.DoScrape(ctx, r)
+	s.id = id
+	if disconnect {
+		// Everyone waiting went away.
+		err = context.Canceled
+	}
+	if err == nil {
+		s.body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		s.resp = resp
+	}
+	s.err = err
+
+	// Later requests start a scrape of their own.
+	c.mu.Lock()
+	if c.shared[key] == s {
+		delete(c.shared, key)
+	}
+	c.mu.Unlock()
+	close(s.done)
+}
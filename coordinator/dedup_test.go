@@ -0,0 +1,146 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+)
+
+func TestDoScrapeSharedLastWaiterLeaves(t *testing.T) {
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	req, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, disconnect := c.DoScrapeShared(ctx, req.WithContext(ctx)); !disconnect {
+		t.Fatal("scrape did not see its requester go away")
+	}
+	// The cancelled scrape may still be winding down, a new request must
+	// not join it.
+	c.mu.Lock()
+	_, ok := c.shared[sharedScrapeKey(req)]
+	c.mu.Unlock()
+	if ok {
+		t.Error("cancelled scrape still shared")
+	}
+}
+
+// Answer scrapes for host:9100 after delay with their Accept and
+// Authorization headers, until stop is closed. Returns how many were answered.
+func answerScrapes(c *Coordinator, delay time.Duration, stop <-chan struct{}) <-chan int {
+	answered := make(chan int, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		n := 0
+		for {
+			req, ok := c.WaitForScrapeInstruction(ctx, []string{"host:9100"}, ClientInfo{}, nil)
+			if !ok {
+				answered <- n
+				return
+			}
+			n++
+			go func() {
+				time.Sleep(delay)
+				body := req.Header.Get("Accept") + " " + req.Header.Get("Authorization")
+				resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body))}
+				resp.Header.Set(util.IDHeader, req.Header.Get(util.IDHeader))
+				c.ScrapeResult(resp)
+			}()
+		}
+	}()
+	return answered
+}
+
+// Scrape host:9100 with header through DoScrapeShared, giving up after timeout.
+func scrapeShared(c *Coordinator, header http.Header, timeout time.Duration) (string, error) {
+	req, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	req.Header = header
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, _, err, _ := c.DoScrapeShared(ctx, req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body), nil
+}
+
+func TestDoScrapeSharedHeaders(t *testing.T) {
+	const text, openMetrics = "text/plain;version=0.0.4", "application/openmetrics-text;version=0.0.1"
+	for name, c := range map[string]struct {
+		first, second http.Header
+		wantScrapes   int
+	}{
+		"identical":            {http.Header{"Accept": {text}}, http.Header{"Accept": {text}}, 1},
+		"other Accept":         {http.Header{"Accept": {text}}, http.Header{"Accept": {openMetrics}}, 2},
+		"other credentials":    {http.Header{"Authorization": {"Bearer a"}}, http.Header{"Authorization": {"Bearer b"}}, 2},
+		"no credentials":       {http.Header{"Authorization": {"Bearer a"}}, http.Header{}, 2},
+		"other scrape timeout": {http.Header{"X-Prometheus-Scrape-Timeout-Seconds": {"10"}}, http.Header{"X-Prometheus-Scrape-Timeout-Seconds": {"5"}}, 2},
+	} {
+		co := newTestCoordinator(Options{})
+		stop := make(chan struct{})
+		answered := answerScrapes(co, 100*time.Millisecond, stop)
+
+		errs := make(chan error, 2)
+		for _, h := range []http.Header{c.first, c.second} {
+			go func(h http.Header) {
+				body, err := scrapeShared(co, h, 5*time.Second)
+				if want := h.Get("Accept") + " " + h.Get("Authorization"); err == nil && body != want {
+					err = fmt.Errorf("got the result for %q, want the one for %q", body, want)
+				}
+				errs <- err
+			}(h)
+			// The second joins the first while it is in flight, if it may.
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+		close(stop)
+		if n := <-answered; n != c.wantScrapes {
+			t.Errorf("%s: client was asked %d times, want %d", name, n, c.wantScrapes)
+		}
+		co.StopGC()
+	}
+}
+
+func TestDoScrapeSharedLaterDeadline(t *testing.T) {
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	stop := make(chan struct{})
+	answered := answerScrapes(c, 200*time.Millisecond, stop)
+
+	// The first gives up before the client answers, the second that joined
+	// it still gets the result.
+	first := make(chan error, 1)
+	go func() {
+		_, err := scrapeShared(c, http.Header{}, 50*time.Millisecond)
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	body, err := scrapeShared(c, http.Header{}, 5*time.Second)
+	if err != nil || body != " " {
+		t.Errorf("second request got %q, %v, want the result", body, err)
+	}
+	if err := <-first; err != ErrScrapeTimeout {
+		t.Errorf("first request got %v, want %v", err, ErrScrapeTimeout)
+	}
+	close(stop)
+	if n := <-answered; n != 1 {
+		t.Errorf("client was asked %d times, want once", n)
+	}
+}
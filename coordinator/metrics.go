@@ -0,0 +1,84 @@
+package coordinator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	duplicateRegistrations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_proxy_duplicate_registrations_total",
+			Help: "Number of polls for an FQDN another client was already polling for.",
+		},
+	)
+	registrationsRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_proxy_registrations_rejected_total",
+			Help: "Number of polls for new FQDNs refused as --registration.max-clients FQDNs were already registered.",
+		},
+	)
+	scrapesInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_scrapes_in_flight",
+			Help: "Number of scrapes currently being handled by the proxy.",
+		},
+	)
+	orphanedResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_orphaned_results_total",
+			Help: "Number of pushed scrape results nobody was waiting for, by reason: \"unknown\" when the scrape had already given up, \"duplicate\" for a second result for a scrape, \"late\" when the result arrived just as the scrape gave up.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scrapesInFlight, orphanedResults, duplicateRegistrations, registrationsRejected)
+}
+
+var (
+	waitingDesc = prometheus.NewDesc(
+		"pushprox_coordinator_waiting_fqdns",
+		"Number of FQDNs with a request channel in the coordinator.",
+		nil, nil,
+	)
+	responsesDesc = prometheus.NewDesc(
+		"pushprox_coordinator_response_channels",
+		"Number of scrapes with a response channel in the coordinator.",
+		nil, nil,
+	)
+	pollersDesc = prometheus.NewDesc(
+		"pushprox_coordinator_pollers",
+		"Number of client connections waiting for a scrape.",
+		nil, nil,
+	)
+	pendingDesc = prometheus.NewDesc(
+		"pushprox_coordinator_pending_scrapes",
+		"Number of scrapes waiting for their client to poll.",
+		nil, nil,
+	)
+	knownDesc = prometheus.NewDesc(
+		"pushprox_coordinator_known_clients",
+		"Number of clients the coordinator has seen within the registration timeout or not yet garbage collected.",
+		nil, nil,
+	)
+)
+
+// A Coordinator is a prometheus.Collector reporting the sizes of its maps
+// when scraped, to spot leaks.
+func (c *Coordinator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- waitingDesc
+	ch <- responsesDesc
+	ch <- knownDesc
+	ch <- pollersDesc
+	ch <- pendingDesc
+}
+
+func (c *Coordinator) Collect(ch chan<- prometheus.Metric) {
+	waiting, responses, known, pollers, pending := c.sizes()
+	ch <- prometheus.MustNewConstMetric(waitingDesc, prometheus.GaugeValue, float64(waiting))
+	ch <- prometheus.MustNewConstMetric(responsesDesc, prometheus.GaugeValue, float64(responses))
+	ch <- prometheus.MustNewConstMetric(knownDesc, prometheus.GaugeValue, float64(known))
+	ch <- prometheus.MustNewConstMetric(pollersDesc, prometheus.GaugeValue, float64(pollers))
+	ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(pending))
+}
@@ -0,0 +1,95 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Wait until c reports the given map sizes, failing the test if it doesn't
+// within a few seconds.
+func expectSizes(t *testing.T, c *Coordinator, waiting, responses, known, pollers, pending int) {
+	want := ""
+	for _, m := range []struct {
+		name, help string
+		value      int
+	}{
+		{"pushprox_coordinator_waiting_fqdns", "Number of FQDNs with a request channel in the coordinator.", waiting},
+		{"pushprox_coordinator_response_channels", "Number of scrapes with a response channel in the coordinator.", responses},
+		{"pushprox_coordinator_known_clients", "Number of clients the coordinator has seen within the registration timeout or not yet garbage collected.", known},
+		{"pushprox_coordinator_pollers", "Number of client connections waiting for a scrape.", pollers},
+		{"pushprox_coordinator_pending_scrapes", "Number of scrapes waiting for their client to poll.", pending},
+	} {
+		want += fmt.Sprintf("# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := testutil.CollectAndCompare(c, strings.NewReader(want))
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCollectTracksMapSizes(t *testing.T) {
+	c := newTestCoordinator(Options{})
+	defer c.StopGC()
+	expectSizes(t, c, 0, 0, 0, 0, 0)
+
+	// A scrape waiting for its client to poll.
+	req, _ := http.NewRequest("GET", "http://host:9100/metrics", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	scraped := make(chan error, 1)
+	go func() {
+		resp, _, err, _ := c.DoScrape(ctx, req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		scraped <- err
+	}()
+	expectSizes(t, c, 1, 1, 0, 0, 1)
+
+	// The client picks it up.
+	handed, ok := c.WaitForScrapeInstruction(context.Background(), []string{"host:9100"}, ClientInfo{}, nil)
+	if !ok {
+		t.Fatal("no scrape handed out")
+	}
+	expectSizes(t, c, 0, 1, 1, 0, 0)
+
+	// Another connection waits for the next one.
+	pollCtx, stopPoll := context.WithCancel(context.Background())
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		c.WaitForScrapeInstruction(pollCtx, []string{"host:9100"}, ClientInfo{}, nil)
+	}()
+	expectSizes(t, c, 1, 1, 1, 1, 0)
+
+	// The result comes in, the scrape is done.
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("up 1\n"))}
+	resp.Header.Set(util.IDHeader, handed.Header.Get(util.IDHeader))
+	if err := c.ScrapeResult(resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-scraped; err != nil {
+		t.Fatal(err)
+	}
+	expectSizes(t, c, 1, 0, 1, 1, 0)
+
+	// And the client disconnects, leaving nothing but its registration behind.
+	stopPoll()
+	<-polled
+	expectSizes(t, c, 0, 0, 1, 0, 0)
+}
@@ -0,0 +1,73 @@
+package coordinator
+
+import (
+	"math/rand"
+	"time"
+)
+
+func init() {
+	// Proxy replicas started together must not pick the same way.
+	rand.Seed(time.Now().UnixNano())
+}
+
+// Picks which of the pollers waiting for an FQDN gets a scrape.
+type selectStrategy interface {
+	// Index in q.pollers of the poller to hand the scrape to. q.pollers is
+	// never empty and is in the order they started waiting. Called with the
+	// Coordinator's lock held.
+	pick(q *pollQueue) int
+}
+
+// Pollers poll again after every scrape, going to the back of the queue, so
+// picking the front one takes them in turns.
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) pick(q *pollQueue) int {
+	return 0
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) pick(q *pollQueue) int {
+	return rand.Intn(len(q.pollers))
+}
+
+// Smooth weighted round-robin across the client instances waiting, so each
+// gets scrapes in proportion to the weight it polled with, spread out rather
+// than in bursts. An instance's several connections count once, the one
+// waiting longest gets the scrape. Clients without an instance ID count as
+// one instance.
+//
+// Every scrape, each instance waiting earns its weight in credit, and the one
+// with the most pays the total earned. An instance busy with a scrape keeps
+// its credit until it polls again.
+type weightedStrategy struct{}
+
+func (weightedStrategy) pick(q *pollQueue) int {
+	if q.credit == nil {
+		q.credit = map[string]int{}
+	}
+	first := map[string]int{}
+	best, total := -1, 0
+	for i, p := range q.pollers {
+		if _, ok := first[p.instance]; ok {
+			continue
+		}
+		first[p.instance] = i
+		q.credit[p.instance] += p.weight
+		total += p.weight
+		if best < 0 || q.credit[p.instance] > q.credit[q.pollers[best].instance] {
+			best = i
+		}
+	}
+	q.credit[q.pollers[best].instance] -= total
+	return best
+}
+
+// By the name Options.SelectStrategy gives.
+var selectStrategies = map[string]selectStrategy{
+	"":            roundRobinStrategy{},
+	"round-robin": roundRobinStrategy{},
+	"random":      randomStrategy{},
+	"weighted":    weightedStrategy{},
+}
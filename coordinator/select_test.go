@@ -0,0 +1,56 @@
+package coordinator
+
+import (
+	"testing"
+)
+
+// Hand out n scrapes to q with s, each picked poller joining the back of
+// the queue again as it would after its scrape. Returns the scrapes each
+// instance got.
+func pickScrapes(s selectStrategy, q *pollQueue, n int) map[string]int {
+	got := map[string]int{}
+	for i := 0; i < n; i++ {
+		p := q.pollers[s.pick(q)]
+		got[p.instance]++
+		q.remove(p)
+		q.pollers = append(q.pollers, p)
+	}
+	return got
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	q := &pollQueue{pollers: []*poller{
+		{instance: "a", weight: 3},
+		{instance: "b", weight: 1},
+		{instance: "c", weight: 2},
+	}}
+	got := pickScrapes(weightedStrategy{}, q, 600)
+	want := map[string]int{"a": 300, "b": 100, "c": 200}
+	for instance, n := range want {
+		if got[instance] != n {
+			t.Errorf("instance %s got %d of 600 scrapes, want %d: %v", instance, got[instance], n, got)
+		}
+	}
+}
+
+func TestWeightedStrategyCountsInstanceOnce(t *testing.T) {
+	// a polls over three connections, which must not triple its share.
+	q := &pollQueue{pollers: []*poller{
+		{instance: "a", weight: 1},
+		{instance: "a", weight: 1},
+		{instance: "a", weight: 1},
+		{instance: "b", weight: 1},
+	}}
+	got := pickScrapes(weightedStrategy{}, q, 100)
+	if got["a"] != 50 || got["b"] != 50 {
+		t.Errorf("got %v scrapes, want 50 each", got)
+	}
+}
+
+func TestWeightedStrategyPicksLongestWaitingConnection(t *testing.T) {
+	first := &poller{instance: "a", weight: 1}
+	q := &pollQueue{pollers: []*poller{first, {instance: "a", weight: 1}}}
+	if i := (weightedStrategy{}).pick(q); q.pollers[i] != first {
+		t.Errorf("picked connection %d, want the one waiting longest", i)
+	}
+}
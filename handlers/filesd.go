@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Keep path in step with /clients, for file_sd_configs. Blocking.
+// Clients can also expire between GC runs without a change signal, so
+// check every interval, the coordinator's GC interval, as well.
+func (h *Handler) WriteFileSDForever(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		data, err := json.MarshalIndent(h.clientTargets(h.coordinator.KnownClientsDetailed(), false), "", "  ")
+		if err != nil {
+			level.Error(h.logger).Log("msg", "Error encoding clients for --clients.file-sd-path", "err", err)
+		} else if !bytes.Equal(data, last) {
+			if err := writeFileAtomic(path, data); err != nil {
+				level.Error(h.logger).Log("msg", "Error writing --clients.file-sd-path", "path", path, "err", err)
+			} else {
+				level.Debug(h.logger).Log("msg", "Wrote clients to --clients.file-sd-path", "path", path)
+				last = data
+			}
+		}
+		select {
+		case <-h.coordinator.Changes():
+		case <-ticker.C:
+		}
+	}
+}
+
+// Write data to path through a temporary file in the same directory, so
+// Prometheus never reads a half written file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// TempFile creates the file readable only by us.
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
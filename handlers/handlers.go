@@ -0,0 +1,946 @@
+// Package handlers serves the HTTP side of the proxy around a
+// coordinator.Coordinator: scrapes from Prometheus, /poll, /push and /ws
+// from clients, and the routes for operators such as /clients and /metrics.
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/pushprox/coordinator"
+	"github.com/adobe/pushprox/util"
+	"golang.org/x/net/websocket"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+)
+
+// Response header the proxy tells Prometheus the scrape ID in, to find the
+// scrape in the proxy's and client's logs.
+const scrapeIDHeader = "X-PushProx-Scrape-Id"
+
+// Where the bearer tokens come from. Asked on every request, so they can
+// change while the proxy is running.
+type Secrets interface {
+	// Token clients must send on /poll, /push and /ws, empty if none.
+	AuthToken() string
+	// Token Prometheus must send to scrape through the proxy, empty if none.
+	ScrapeAuthToken() string
+}
+
+// No tokens, for when Options.Secrets is nil.
+type noSecrets struct{}
+
+func (noSecrets) AuthToken() string       { return "" }
+func (noSecrets) ScrapeAuthToken() string { return "" }
+
+// How a Handler behaves, the proxy fills it in from its flags. The zero
+// value serves every route on the Handler, without auth or limits.
+type Options struct {
+	// Prefix for the routes other than scrapes, such as /poll and /push, for
+	// when the proxy is served under a sub-path by a reverse proxy.
+	RoutePrefix string
+	// Leave the routes for operators to Admin instead of serving them as well.
+	SeparateAdmin bool
+	// The tokens clients and Prometheus must send, nil for none.
+	Secrets Secrets
+	// Require a verified client certificate valid for every FQDN registered
+	// on /poll and /ws. The server's TLS config must ask for one.
+	RequireClientCert bool
+	// Largest /push body accepted from a client, also once decompressed. 0 disables.
+	PushMaxBodyBytes int64
+	// Pushed bodies larger than this are buffered in a temporary file instead of memory. 0 disables.
+	PushSpillThreshold int64
+	// Pass pushed scrape results on as they arrive instead of buffering them whole first.
+	PushStream bool
+	// Give up on a /push whose body sends nothing for this long, on
+	// connections seen by TrackConn. 0 disables.
+	PushBodyTimeout time.Duration
+	// Labels as name=value added to every sample of every scrape, and
+	// regexes of metric names dropped from it.
+	InjectLabels []string
+	DropMetrics  []string
+	// How many times to dispatch a scrape again when the client reports one of ScrapeRetryStatus.
+	ScrapeRetries     int
+	ScrapeRetryStatus []int
+	// Have identical scrapes wait for the result of one in flight, see Coordinator.DoScrapeShared.
+	ScrapeDedup bool
+	// Scrapes per second allowed from a single requester IP, and how many more in a burst. 0 disables.
+	ScrapeRateLimit float64
+	ScrapeRateBurst int
+	// Mark successful scrape results that don't parse in the text format with
+	// an X-PushProx-Invalid-Metrics header.
+	ValidateMetrics bool
+	// Write a byte to waiting polls of clients that support it this often. 0 disables.
+	PollKeepaliveInterval time.Duration
+	// How long clients turned away as too many are polling are asked to wait.
+	PollRetryAfter time.Duration
+	// Add the IP each client last polled from to its targets in /clients as the source_ip label.
+	ExposeSourceIP bool
+	// Serve Go profiling data under /debug/pprof/ with the routes for operators.
+	EnablePprof bool
+}
+
+// Serves the proxy's routes for a Coordinator.
+type Handler struct {
+	coordinator *coordinator.Coordinator
+	opts        Options
+	secrets     Secrets
+	// RoutePrefix in the form "/prefix", or "" for none.
+	prefix string
+	// Rewrites scrape results, nil if there is nothing to do.
+	transform *transformer
+	// Limits scrapes per requester, nil if ScrapeRateLimit is 0.
+	limiter *coordinator.RateLimiter
+	metrics http.Handler
+	// nil unless EnablePprof is set.
+	pprof http.Handler
+	// The connections of the server by remote address, kept up to date by
+	// TrackConn, so a handler can set deadlines on its own.
+	conns sync.Map
+	// Set once the server is accepting connections.
+	ready  int32
+	logger log.Logger
+}
+
+// Returns an error if the InjectLabels or DropMetrics options don't parse.
+func New(c *coordinator.Coordinator, logger log.Logger, opts Options) (*Handler, error) {
+	transform, err := newTransformer(opts.InjectLabels, opts.DropMetrics)
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		coordinator: c,
+		opts:        opts,
+		secrets:     opts.Secrets,
+		prefix:      normalizeRoutePrefix(opts.RoutePrefix),
+		transform:   transform,
+		metrics:     promhttp.Handler(),
+		logger:      logger,
+	}
+	if h.secrets == nil {
+		h.secrets = noSecrets{}
+	}
+	if opts.ScrapeRateLimit > 0 {
+		h.limiter = coordinator.NewRateLimiter(opts.ScrapeRateLimit, opts.ScrapeRateBurst)
+	}
+	// net/http/pprof registers itself on http.DefaultServeMux, so use our own mux to keep it off unless asked for.
+	if opts.EnablePprof {
+		pprofMux := http.NewServeMux()
+		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+		pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		h.pprof = http.StripPrefix(h.prefix, pprofMux)
+	}
+	return h, nil
+}
+
+// Have /readyz report ready, once the server accepts connections.
+func (h *Handler) SetReady() {
+	atomic.StoreInt32(&h.ready, 1)
+}
+
+// The routes for operators alone, to serve on a separate address with SeparateAdmin.
+func (h *Handler) Admin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, h.prefix+"/") || !h.serveAdmin(w, r, strings.TrimPrefix(r.URL.Path, h.prefix)) {
+			http.Error(w, "404: Unknown path", 404)
+		}
+	})
+}
+
+// Serve the routes for operators rather than for clients or Prometheus.
+// path is without the route prefix. Returns false for any other path.
+func (h *Handler) serveAdmin(w http.ResponseWriter, r *http.Request, path string) bool {
+	if strings.HasPrefix(path, "/clients/") && r.Method == http.MethodDelete {
+		// Anyone who can reach the main address could otherwise knock clients off.
+		if token := h.secrets.AuthToken(); !h.opts.SeparateAdmin && (token == "" || !hasBearerToken(r, token)) {
+			http.Error(w, "403: Deregistering clients needs --web.admin-listen-address or --web.auth-token", http.StatusForbidden)
+			return true
+		}
+		fqdn := coordinator.NormalizeKey(strings.TrimPrefix(path, "/clients/"))
+		if !h.coordinator.Deregister(fqdn) {
+			http.Error(w, "404: Unknown client "+fqdn, http.StatusNotFound)
+			return true
+		}
+		w.Write([]byte("Deregistered " + fqdn + "\n"))
+		return true
+	}
+
+	if path == "/clients" {
+		verbose := r.URL.Query().Get("verbose") == "true"
+		targets := h.clientTargets(h.coordinator.KnownClientsDetailed(), verbose)
+		json.NewEncoder(w).Encode(targets)
+		level.Info(h.logger).Log("msg", "Responded to /clients", "client_count", len(targets), "verbose", verbose)
+		return true
+	}
+
+	if path == "/targets" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(targetInfos(h.coordinator.KnownClientsDetailed(), h.coordinator.InFlightByFQDN()))
+		return true
+	}
+
+	if path == "/metrics" {
+		h.metrics.ServeHTTP(w, r)
+		return true
+	}
+
+	if path == "/version" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versionInfo{
+			Version:   version.Version,
+			Revision:  version.Revision,
+			Branch:    version.Branch,
+			BuildUser: version.BuildUser,
+			BuildDate: version.BuildDate,
+			GoVersion: version.GoVersion,
+			StartTime: startTime.UTC(),
+		})
+		return true
+	}
+
+	if path == "/healthz" {
+		if !h.coordinator.Healthy() {
+			http.Error(w, "Coordinator is unhealthy", http.StatusServiceUnavailable)
+			return true
+		}
+		w.Write([]byte("OK\n"))
+		return true
+	}
+
+	// Only reached for requests to the proxy itself, never for scrapes of a client's /debug/pprof/.
+	if h.pprof != nil && strings.HasPrefix(path, "/debug/pprof/") {
+		h.pprof.ServeHTTP(w, r)
+		return true
+	}
+
+	return false
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Proxy request
+	if r.URL.Host != "" {
+		if token := h.secrets.ScrapeAuthToken(); token != "" {
+			if !hasBearerToken(r, token) {
+				http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			// Meant for us, not for the target.
+			r.Header.Del("Authorization")
+		}
+		if h.limiter != nil && !h.limiter.Allow(requesterIP(r)) {
+			scrapeRateLimited.Inc()
+			level.Warn(h.logger).Log("msg", "Scrape rate limit exceeded", "requester", requesterIP(r), "url", r.URL.String())
+			w.Header().Set(util.ScrapeErrorHeader, "rate_limited")
+			scrapeError(w, r, "429: Too many scrapes", http.StatusTooManyRequests)
+			return
+		}
+		timeout := h.coordinator.ScrapeTimeout(r.Header)
+		level.Debug(h.logger).Log("msg", "Scraping", "timeout", timeout)
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		request := r.WithContext(ctx)
+		request.RequestURI = ""
+
+		resp, id, err, disconnect := h.scrapeWithRetries(ctx, request)
+		if disconnect {
+			level.Error(h.logger).Log("msg", "Scraping: Disconnected")
+			return
+		}
+		// Not set if the scrape never got to a client.
+		if id != "" {
+			w.Header().Set(scrapeIDHeader, id)
+		}
+		if err != nil {
+			level.Error(h.logger).Log("msg", "Error scraping:", "err", err, "url", request.URL.String())
+			status, class := 500, "proxy"
+			if _, ok := err.(coordinator.NoClientError); ok {
+				status, class = http.StatusBadGateway, "no_client"
+			}
+			switch err {
+			case coordinator.ErrScrapeTimeout:
+				status, class = http.StatusGatewayTimeout, "timeout"
+			case coordinator.ErrTooManyScrapes, coordinator.ErrPendingQueueFull:
+				status, class = http.StatusTooManyRequests, "overloaded"
+			case coordinator.ErrDraining:
+				status = http.StatusServiceUnavailable
+			case coordinator.ErrRateLimited:
+				scrapeRateLimited.Inc()
+				status, class = http.StatusTooManyRequests, "rate_limited"
+			}
+			w.Header().Set(util.ScrapeErrorHeader, class)
+			scrapeError(w, request, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), err.Error()), status)
+			return
+		}
+		defer resp.Body.Close()
+		if class := resp.Header.Get(util.ScrapeErrorHeader); class != "" {
+			level.Warn(h.logger).Log("msg", "Client failed to scrape its target", "class", class, "url", request.URL.String(), "status", resp.StatusCode)
+			if copyScrapeError(w, request, resp) {
+				return
+			}
+		}
+		if h.opts.ValidateMetrics && validatable(resp) {
+			buf, parseErr, err := validateBody(resp, h.opts.PushSpillThreshold)
+			if err != nil {
+				level.Error(h.logger).Log("msg", "Error reading scrape result", "err", err, "url", request.URL.String())
+				w.Header().Set(util.ScrapeErrorHeader, "proxy")
+				scrapeError(w, request, fmt.Sprintf("Error reading scrape result of %q: %s", request.URL.String(), err), http.StatusBadGateway)
+				return
+			}
+			defer buf.Close()
+			if parseErr != nil {
+				invalidScrapes.Inc()
+				level.Warn(h.logger).Log("msg", "Scrape result does not parse", "url", request.URL.String(), "err", parseErr)
+				resp.Header.Set(invalidMetricsHeader, parseErr.Error())
+			}
+		}
+		level.Debug(h.logger).Log("msg", "Scraping: Sending scrap response")
+		// Ours, not whatever the target may have sent.
+		resp.Header.Del(scrapeIDHeader)
+		written, err := copyHTTPResponse(resp, w, h.transform)
+		if err != nil {
+			// Most likely a streamed push broke off. The status is already out, so break the
+			// connection rather than let a partial result pass as a complete one.
+			level.Error(h.logger).Log("msg", "Error copying scrape result", "err", err, "url", request.URL.String())
+			panic(http.ErrAbortHandler)
+		}
+		scrapeAmplification.Observe(float64(written) / float64(requestSize(r)))
+		return
+	}
+
+	// All other routes live under the route prefix.
+	if !strings.HasPrefix(r.URL.Path, h.prefix+"/") {
+		http.Error(w, "404: Unknown path", 404)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, h.prefix)
+
+	if token := h.secrets.AuthToken(); (path == "/poll" || path == "/push" || path == "/ws") && token != "" && !hasBearerToken(r, token) {
+		level.Warn(h.logger).Log("msg", "Rejected unauthenticated request", "path", path, "requester", requesterIP(r))
+		http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Client registering and asking for scrapes.
+	if path == "/poll" {
+		if h.coordinator.Draining() {
+			http.Error(w, "503: Proxy is shutting down", 503)
+			return
+		}
+		if h.coordinator.PollersFull() {
+			h.rejectPoll(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		keys := pollKeys(string(body))
+		if len(keys) == 0 {
+			http.Error(w, "400: No FQDN in /poll", http.StatusBadRequest)
+			return
+		}
+		if h.opts.RequireClientCert {
+			if err := checkClientCert(r, keys); err != nil {
+				level.Warn(h.logger).Log("msg", "Rejected /poll", "requester", requesterIP(r), "fqdn", strings.Join(keys, ","), "err", err)
+				http.Error(w, "403: "+err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		info := pollClientInfo(r, h.logger)
+		if err := h.coordinator.CheckRegistration(keys, info); err == coordinator.ErrTooManyRegistrations {
+			http.Error(w, "429: "+err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			http.Error(w, "409: "+err.Error(), http.StatusConflict)
+			return
+		}
+		key := strings.Join(keys, ",")
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		var keepalive *pollKeepalive
+		if h.opts.PollKeepaliveInterval > 0 && r.Header.Get("X-PushProx-Keepalive") == "true" {
+			keepalive = startPollKeepalive(w, h.opts.PollKeepaliveInterval, cancel)
+		}
+		request, doscrape := h.coordinator.WaitForScrapeInstruction(ctx, keys, info, nil)
+		if keepalive != nil {
+			keepalive.Stop()
+			// The status is already sent, an empty body tells the client to poll again.
+			if doscrape {
+				writeScrapeRequest(w, request)
+				level.Debug(h.logger).Log("msg", "Responded to /poll", "url", request.URL.String(), "scrape_id", request.Header.Get(util.IDHeader))
+			}
+			return
+		}
+		if doscrape {
+			writeScrapeRequest(w, request) // Send full request as the body of the response.
+			level.Debug(h.logger).Log("msg", "Responded to /poll", "url", request.URL.String(), "scrape_id", request.Header.Get(util.IDHeader))
+		} else if h.coordinator.Draining() {
+			http.Error(w, "503: Proxy is shutting down", 503)
+		} else {
+			// Either the client has gone or its poll expired, in which case
+			// tell it to come back without a scrape.
+			w.WriteHeader(http.StatusNoContent)
+			level.Debug(h.logger).Log("msg", "Released /poll without a scrape", "fqdn", key)
+		}
+		return
+	}
+
+	// Scrape response from client.
+	if path == "/push" {
+		conn := h.requestConn(r)
+		if conn != nil && h.opts.PushBodyTimeout > 0 {
+			r.Body = &stallReader{ReadCloser: r.Body, conn: conn, timeout: h.opts.PushBodyTimeout}
+		}
+		if h.opts.PushMaxBodyBytes > 0 {
+			// enforced while buffering, before the response is parsed.
+			r.Body = http.MaxBytesReader(w, r.Body, h.opts.PushMaxBodyBytes)
+		}
+		status, err := h.pushResult(r.Body, r.Header.Get("Content-Encoding"), h.opts.PushStream)
+		if status == http.StatusRequestTimeout {
+			// The rest of the body is not worth waiting for, so leave the
+			// deadline in the past and the connection to be closed.
+			w.Header().Set("Connection", "close")
+		} else if conn != nil && h.opts.PushBodyTimeout > 0 {
+			// Other requests on the connection are not held to it.
+			conn.SetReadDeadline(time.Time{})
+		}
+		if err != nil {
+			http.Error(w, err.Error(), status)
+		}
+		return
+	}
+
+	if path == "/ws" {
+		if h.coordinator.Draining() {
+			http.Error(w, "503: Proxy is shutting down", 503)
+			return
+		}
+		if h.coordinator.PollersFull() {
+			h.rejectPoll(w, r)
+			return
+		}
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			h.serveWebsocket(ws)
+		}}.ServeHTTP(w, r)
+		return
+	}
+
+	if !h.opts.SeparateAdmin && h.serveAdmin(w, r, path) {
+		return
+	}
+
+	if path == "/readyz" {
+		if atomic.LoadInt32(&h.ready) == 0 || h.coordinator.Draining() || !h.coordinator.Healthy() {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK\n"))
+		return
+	}
+
+	http.Error(w, "404: Unknown path", 404)
+}
+
+// Whether a scrape that came back with this status should be dispatched again.
+func (h *Handler) retryableStatus(code int) bool {
+	for _, c := range h.opts.ScrapeRetryStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// DoScrape, dispatching again up to ScrapeRetries times while the client
+// reports a retryable status and the scrape deadline has not passed.
+// Returns the scrape ID of the last attempt.
+func (h *Handler) scrapeWithRetries(ctx context.Context, request *http.Request) (*http.Response, string, error, bool) {
+	doScrape := h.coordinator.DoScrape
+	if h.opts.ScrapeDedup {
+		doScrape = h.coordinator.DoScrapeShared
+	}
+	for attempt := 0; ; attempt++ {
+		resp, id, err, disconnect := doScrape(ctx, request)
+		if err != nil || disconnect || attempt >= h.opts.ScrapeRetries || !h.retryableStatus(resp.StatusCode) || ctx.Err() != nil {
+			return resp, id, err, disconnect
+		}
+		level.Info(h.logger).Log("msg", "Retrying scrape", "url", request.URL.String(), "status", resp.StatusCode, "attempt", attempt+1)
+		resp.Body.Close()
+	}
+}
+
+// Returns the number of body bytes written.
+// The body is rewritten by t on the way through if it is not nil.
+func copyHTTPResponse(resp *http.Response, w http.ResponseWriter, t *transformer) (int64, error) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	// Trailers have to be announced before the body, their values are only known after it.
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	var n int64
+	var err error
+	if t != nil && t.handles(resp.Header) {
+		// The length changes as the body is rewritten.
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		n, err = t.CopyEncoded(w, resp.Body, resp.Header.Get("Content-Encoding"))
+	} else {
+		w.WriteHeader(resp.StatusCode)
+		n, err = io.Copy(w, resp.Body)
+	}
+	for k, v := range resp.Trailer {
+		w.Header()[k] = v
+	}
+	return n, err
+}
+
+var (
+	errLengthMismatch = errors.New("body length does not match Content-Length")
+	errBodyTooLarge   = errors.New("body larger than --push.max-body-bytes")
+)
+
+// Parse the scrape response a client sent to /push, making sure its
+// body is as long as it claims so truncated pushes don't reach Prometheus.
+// body must already be limited to limit bytes by http.MaxBytesReader, 0 means no limit.
+// Bodies past spillThreshold bytes are spilled to disk, closing the returned body cleans them up.
+func readPushedResponse(body io.Reader, limit, spillThreshold int64) (*http.Response, error) {
+	buf := util.NewSpillBuffer(spillThreshold)
+	if _, err := io.Copy(buf, body); err != nil {
+		defer buf.Close()
+		if limit > 0 && buf.Len() >= limit {
+			return nil, errBodyTooLarge
+		}
+		if isTimeout(err) {
+			// The headers, and with them the scrape ID, usually got through.
+			stalled := pushStalledError{err: err}
+			if resp, err := http.ReadResponse(bufio.NewReader(buf.Reader()), nil); err == nil {
+				stalled.id = resp.Header.Get(util.IDHeader)
+			}
+			return nil, stalled
+		}
+		return nil, err
+	}
+	cr := &countingReader{r: buf.Reader()}
+	br := bufio.NewReader(cr)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+	if resp.ContentLength >= 0 {
+		// Everything after the headers must be exactly the declared body.
+		headerLen := cr.n - int64(br.Buffered())
+		if buf.Len()-headerLen != resp.ContentLength {
+			buf.Close()
+			return nil, errLengthMismatch
+		}
+	}
+	resp.Body = spillBody{ReadCloser: resp.Body, buf: buf}
+	return resp, nil
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Fails with errBodyTooLarge once more than n bytes could be read from r,
+// like http.MaxBytesReader for readers that are not a request body.
+type maxBytesReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.n <= 0 {
+		// Only too large if there is more.
+		var b [1]byte
+		n, err := m.r.Read(b[:])
+		if n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > m.n {
+		p = p[:m.n]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	return n, err
+}
+
+// A response body that removes the buffer it is read from when closed.
+type spillBody struct {
+	io.ReadCloser
+	buf *util.SpillBuffer
+}
+
+func (b spillBody) Close() error {
+	b.ReadCloser.Close()
+	return b.buf.Close()
+}
+
+// Rough size of a request as received, used for the amplification ratio.
+func requestSize(r *http.Request) int64 {
+	size := int64(len(r.Method) + len(r.URL.String()) + len(r.Proto))
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v))
+		}
+	}
+	if r.ContentLength > 0 {
+		size += r.ContentLength
+	}
+	return size
+}
+
+// The IP part of the requester's address.
+func requesterIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Hand a pushed scrape result to the coordinator. body is the serialized
+// response as a client sends it to /push, gzipped if contentEncoding says so.
+// With stream the body is handed on as it is read, and this only returns
+// once the scrape is done with it.
+// Returns the status to answer the push with when it fails.
+func (h *Handler) pushResult(body io.Reader, contentEncoding string, stream bool) (int, error) {
+	// older clients push uncompressed, newer ones gzip by default.
+	if contentEncoding == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			level.Error(h.logger).Log("msg", "Error decompressing /push:", "err", err)
+			return http.StatusBadRequest, fmt.Errorf("Error decompressing pushed response: %s", err)
+		}
+		defer gz.Close()
+		body = gz
+		if h.opts.PushMaxBodyBytes > 0 {
+			// A few compressed bytes can inflate to any size, so the
+			// decompressed body is held to the limit as well.
+			body = &maxBytesReader{r: gz, n: h.opts.PushMaxBodyBytes}
+		}
+	}
+	var scrapeResult *http.Response
+	var streamed *streamBody
+	var err error
+	if stream {
+		scrapeResult, streamed, err = readStreamedResponse(body)
+	} else {
+		scrapeResult, err = readPushedResponse(body, h.opts.PushMaxBodyBytes, h.opts.PushSpillThreshold)
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		switch err {
+		case errLengthMismatch:
+			pushLengthMismatch.Inc()
+		case errBodyTooLarge:
+			status = http.StatusRequestEntityTooLarge
+		}
+		if stalled, ok := err.(pushStalledError); ok {
+			status = http.StatusRequestTimeout
+			if stalled.id != "" {
+				// No point in the scrape waiting for the rest.
+				h.coordinator.FailScrape(stalled.id, http.StatusGatewayTimeout, "timeout", "The client stalled pushing the scrape result")
+			}
+		} else if isTimeout(err) {
+			status = http.StatusRequestTimeout
+		}
+		level.Error(h.logger).Log("msg", "Error parsing /push:", "err", err)
+		return status, fmt.Errorf("Error parsing pushed response: %s", err)
+	}
+	level.Info(h.logger).Log("msg", "Got /push", "scrape_id", scrapeResult.Header.Get(util.IDHeader))
+	err = h.coordinator.ScrapeResult(scrapeResult)
+	if err != nil {
+		// Nobody is going to read it.
+		scrapeResult.Body.Close()
+		if err == coordinator.ErrDuplicateResult {
+			// The scrape got the first copy, so as far as the client is concerned this worked.
+			level.Debug(h.logger).Log("msg", "Dropping duplicate push", "scrape_id", scrapeResult.Header.Get(util.IDHeader))
+			return 0, nil
+		}
+		if err == coordinator.ErrUnknownScrape {
+			// Prometheus gave up on the scrape, nothing wrong on our side.
+			level.Warn(h.logger).Log("msg", "Dropping push", "err", err, "scrape_id", scrapeResult.Header.Get(util.IDHeader))
+			return http.StatusGone, fmt.Errorf("Error pushing: %s", err)
+		}
+		level.Error(h.logger).Log("msg", "Error pushing:", "err", err, "scrape_id", scrapeResult.Header.Get(util.IDHeader))
+		return http.StatusInternalServerError, fmt.Errorf("Error pushing: %s", err)
+	}
+	if streamed != nil {
+		<-streamed.done
+		if streamed.err != nil {
+			// The scrape already passed on what it got, all we can do is tell the client.
+			if streamed.err == io.ErrUnexpectedEOF {
+				pushLengthMismatch.Inc()
+			}
+			level.Error(h.logger).Log("msg", "Error streaming /push:", "err", streamed.err, "scrape_id", scrapeResult.Header.Get(util.IDHeader))
+			if isTimeout(streamed.err) {
+				return http.StatusRequestTimeout, fmt.Errorf("Error reading pushed response: %s", streamed.err)
+			}
+			return http.StatusBadRequest, fmt.Errorf("Error reading pushed response: %s", streamed.err)
+		}
+	}
+	return 0, nil
+}
+
+// The keys a client registers, from a /poll body of one or more FQDNs
+// separated by whitespace. the key is the FQDN and the port.
+func pollKeys(body string) []string {
+	keys := strings.Fields(body)
+	for i, key := range keys {
+		keys[i] = coordinator.NormalizeKey(key)
+	}
+	return keys
+}
+
+// What a polling client tells us about itself in its request headers.
+func pollClientInfo(r *http.Request, logger log.Logger) coordinator.ClientInfo {
+	return coordinator.ClientInfo{
+		Instance:     r.Header.Get("X-PushProx-Instance"),
+		PollInterval: pollInterval(r.Header),
+		Weight:       pollWeight(r.Header),
+		Labels:       clientLabels(r.Header, logger),
+		Meta:         clientMeta(r.Header, logger),
+		MetricsPath:  clientMetricsPath(r.Header),
+		SourceIP:     requesterIP(r),
+	}
+}
+
+// The path a client sent as X-PushProx-Metrics-Path on /poll, empty if it
+// did not send an absolute path.
+func clientMetricsPath(h http.Header) string {
+	path := h.Get("X-PushProx-Metrics-Path")
+	if !strings.HasPrefix(path, "/") {
+		return ""
+	}
+	return path
+}
+
+// Write a scrape request out to the client that picked it up.
+// The request is shared with the scrape waiting for its result, so only a copy is changed.
+func writeScrapeRequest(w io.Writer, request *http.Request) error {
+	out := *request
+	out.Header = util.CloneHeader(request.Header)
+	// The request may have waited for a poll, only give the client what is left
+	// of Prometheus' timeout.
+	if deadline, ok := request.Context().Deadline(); ok {
+		out.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
+	}
+	// Also put the ID in the URL, in case something between us and the client strips the header.
+	u := *request.URL
+	q := u.Query()
+	q.Set(util.IDParam, request.Header.Get(util.IDHeader))
+	u.RawQuery = q.Encode()
+	out.URL = &u
+	return out.WriteProxy(w)
+}
+
+// The poll interval a client advertised, 0 if it did not or it is nonsense.
+func pollInterval(h http.Header) time.Duration {
+	seconds, err := strconv.ParseFloat(h.Get("X-PushProx-Poll-Interval-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * 1e9)
+}
+
+// The weight a client sent as X-PushProx-Weight on /poll, 0 if it sent none or an invalid one.
+func pollWeight(h http.Header) int {
+	weight, err := strconv.Atoi(h.Get("X-PushProx-Weight"))
+	if err != nil || weight < 1 {
+		return 0
+	}
+	return weight
+}
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// The static labels a client sent as X-PushProx-Label: name=value headers on /poll.
+func clientLabels(h http.Header, logger log.Logger) map[string]string {
+	values := h["X-Pushprox-Label"]
+	if len(values) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || !labelNameRE.MatchString(parts[0]) {
+			level.Warn(logger).Log("msg", "Ignoring invalid client label", "label", v)
+			continue
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels
+}
+
+// The metadata a client advertised with X-PushProx-Job and X-PushProx-Meta
+// headers, the job under the name "job".
+func clientMeta(h http.Header, logger log.Logger) map[string]string {
+	job, values := h.Get("X-PushProx-Job"), h["X-Pushprox-Meta"]
+	if job == "" && len(values) == 0 {
+		return nil
+	}
+	meta := make(map[string]string, len(values)+1)
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || !labelNameRE.MatchString(parts[0]) {
+			level.Warn(logger).Log("msg", "Ignoring invalid client metadata", "meta", v)
+			continue
+		}
+		meta[parts[0]] = parts[1]
+	}
+	if job != "" {
+		meta["job"] = job
+	}
+	return meta
+}
+
+// Turn a client away because the coordinator's PollMaxClients are already polling.
+// Clients add jitter to Retry-After, so they don't all come back at once.
+func (h *Handler) rejectPoll(w http.ResponseWriter, r *http.Request) {
+	pollsRejected.Inc()
+	level.Debug(h.logger).Log("msg", "Too many clients polling, rejecting", "requester", requesterIP(r))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(h.opts.PollRetryAfter.Seconds()))))
+	http.Error(w, "503: Too many clients polling", http.StatusServiceUnavailable)
+}
+
+// Whether r carries "Authorization: Bearer <token>", compared in constant time.
+func hasBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// Turn a RoutePrefix into the form "/prefix", or "" for none.
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// The target groups /clients and WriteFileSDForever list for known, sorted by target.
+// verbose adds the last_seen and instance_id labels, ExposeSourceIP the source_ip label.
+func (h *Handler) clientTargets(known map[string]coordinator.ClientInfo, verbose bool) []*targetGroup {
+	targets := make([]*targetGroup, 0, len(known))
+	for k, info := range known {
+		labels := info.Labels
+		if verbose || h.opts.ExposeSourceIP || len(info.Meta) > 0 || info.MetricsPath != "" {
+			labels = map[string]string{}
+			for name, value := range info.Labels {
+				labels[name] = value
+			}
+		}
+		if verbose {
+			labels["last_seen"] = info.LastSeen.UTC().Format(time.RFC3339)
+			if info.Instance != "" {
+				labels["instance_id"] = info.Instance
+			}
+		}
+		if h.opts.ExposeSourceIP {
+			labels["source_ip"] = info.SourceIP
+		}
+		// Prometheus drops __meta_ labels after relabeling, so they only steer it.
+		for name, value := range info.Meta {
+			labels["__meta_pushprox_"+name] = value
+		}
+		// Each pull URL is its own target, so Prometheus has to ask for its path.
+		if _, ok := labels["__metrics_path__"]; !ok && info.MetricsPath != "" {
+			labels["__metrics_path__"] = info.MetricsPath
+		}
+		targets = append(targets, &targetGroup{Targets: []string{k}, Labels: labels})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Targets[0] < targets[j].Targets[0] })
+	return targets
+}
+
+// An entry of /targets, everything the proxy knows about a client.
+type targetInfo struct {
+	FQDN     string    `json:"fqdn"`
+	LastSeen time.Time `json:"last_seen"`
+	// 0 if the client did not advertise it.
+	PollIntervalSeconds float64           `json:"poll_interval_seconds"`
+	InstanceID          string            `json:"instance_id,omitempty"`
+	Labels              map[string]string `json:"labels"`
+	Meta                map[string]string `json:"meta,omitempty"`
+	MetricsPath         string            `json:"metrics_path,omitempty"`
+	ScrapesInFlight     int               `json:"scrapes_in_flight"`
+}
+
+// What /targets lists for known, sorted by FQDN.
+func targetInfos(known map[string]coordinator.ClientInfo, inFlight map[string]int) []targetInfo {
+	targets := make([]targetInfo, 0, len(known))
+	for k, info := range known {
+		labels := info.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		targets = append(targets, targetInfo{
+			FQDN:                k,
+			LastSeen:            info.LastSeen.UTC(),
+			PollIntervalSeconds: info.PollInterval.Seconds(),
+			InstanceID:          info.Instance,
+			Labels:              labels,
+			Meta:                info.Meta,
+			MetricsPath:         info.MetricsPath,
+			ScrapesInFlight:     inFlight[k],
+		})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].FQDN < targets[j].FQDN })
+	return targets
+}
+
+// What /version returns.
+type versionInfo struct {
+	Version   string    `json:"version"`
+	Revision  string    `json:"revision"`
+	Branch    string    `json:"branch"`
+	BuildUser string    `json:"build_user"`
+	BuildDate string    `json:"build_date"`
+	GoVersion string    `json:"go_version"`
+	StartTime time.Time `json:"start_time"`
+}
@@ -0,0 +1,693 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/coordinator"
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+)
+
+// A Handler with opts around a coordinator of its own with copts, stop it
+// with h.coordinator.StopGC.
+func newTestHandler(copts coordinator.Options, opts Options) *Handler {
+	c, err := coordinator.New(log.NewNopLogger(), copts)
+	if err != nil {
+		panic(err)
+	}
+	h, err := New(c, log.NewNopLogger(), opts)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+func TestWriteScrapeRequestLeavesRequestAlone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequest("GET", "http://target:9100/metrics", nil)
+	req = req.WithContext(ctx)
+	req.Header.Set(util.IDHeader, "42")
+
+	var buf bytes.Buffer
+	if err := writeScrapeRequest(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Header) != 1 {
+		t.Errorf("request header changed to %v", req.Header)
+	}
+	if req.URL.RawQuery != "" {
+		t.Errorf("request URL changed to %v", req.URL)
+	}
+
+	written, err := http.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.Header.Get("X-Prometheus-Scrape-Timeout-Seconds") == "" {
+		t.Error("no scrape timeout written")
+	}
+	if got := written.URL.Query().Get(util.IDParam); got != "42" {
+		t.Errorf("got ID %q in the URL, want 42", got)
+	}
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(b)
+	gz.Close()
+	return buf.Bytes()
+}
+
+// A push body of 64MiB, counting how much of it was read.
+type hugeBody struct{ read int64 }
+
+func (b *hugeBody) Read(p []byte) (int, error) {
+	left := 64<<20 - b.read
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	for i := range p {
+		p[i] = '0'
+	}
+	b.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestPushTooLarge(t *testing.T) {
+	const limit = 64 << 10
+	h := newTestHandler(coordinator.Options{}, Options{PushMaxBodyBytes: limit})
+	defer h.coordinator.StopGC()
+
+	body := &hugeBody{}
+	r := httptest.NewRequest("POST", "/push", io.MultiReader(strings.NewReader("HTTP/1.1 200 OK\r\n\r\n"), body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	// Reading stops at the limit rather than buffering the whole body.
+	if body.read > 2*limit {
+		t.Errorf("read %d bytes of the push, want at most about %d", body.read, limit)
+	}
+
+	// Just within the limit still goes through to the coordinator.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/push", strings.NewReader("HTTP/1.1 200 OK\r\nId: 1\r\nContent-Length: 4\r\n\r\n"+strings.Repeat("0", 4))))
+	if w.Code == http.StatusRequestEntityTooLarge {
+		t.Errorf("small push rejected as too large")
+	}
+}
+
+func TestPushGzipBombTooLarge(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{PushMaxBodyBytes: 64 << 10})
+	defer h.coordinator.StopGC()
+
+	body := "HTTP/1.1 200 OK\r\nContent-Length: 1048576\r\n\r\n" + strings.Repeat("0", 1<<20)
+	push := gzipped([]byte(body))
+	if int64(len(push)) > h.opts.PushMaxBodyBytes {
+		t.Fatalf("compressed push of %d bytes is already too large", len(push))
+	}
+	status, err := h.pushResult(bytes.NewReader(push), "gzip", false)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d, %v, want %d", status, err, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestMaxBytesReaderAtLimit(t *testing.T) {
+	b, err := ioutil.ReadAll(&maxBytesReader{r: strings.NewReader("12345"), n: 5})
+	if err != nil || string(b) != "12345" {
+		t.Errorf("got %q, %v, want the whole body", b, err)
+	}
+	_, err = ioutil.ReadAll(&maxBytesReader{r: strings.NewReader("123456"), n: 5})
+	if err != errBodyTooLarge {
+		t.Errorf("got %v, want %v", err, errBodyTooLarge)
+	}
+}
+
+func TestClientTargetsMetricsPath(t *testing.T) {
+	poll := func(path string, labels ...string) coordinator.ClientInfo {
+		r, _ := http.NewRequest("POST", "http://proxy/poll", nil)
+		if path != "" {
+			r.Header.Set("X-PushProx-Metrics-Path", path)
+		}
+		for _, l := range labels {
+			r.Header.Add("X-PushProx-Label", l)
+		}
+		return pollClientInfo(r, log.NewNopLogger())
+	}
+	known := map[string]coordinator.ClientInfo{
+		"host:9100": poll("/metrics"),
+		"host:9115": poll("/probe"),
+		"host:9200": poll("/custom", "__metrics_path__=/override"),
+		"host:9300": poll(""),
+		"host:9400": poll("relative"),
+	}
+	want := map[string]string{
+		"host:9100": "/metrics",
+		"host:9115": "/probe",
+		"host:9200": "/override",
+		"host:9300": "",
+		"host:9400": "",
+	}
+	h := &Handler{}
+	for _, g := range h.clientTargets(known, false) {
+		if got := g.Labels["__metrics_path__"]; got != want[g.Targets[0]] {
+			t.Errorf("%s: got __metrics_path__ %q, want %q", g.Targets[0], got, want[g.Targets[0]])
+		}
+	}
+	// The labels of the client must not be changed for the next listing.
+	if _, ok := known["host:9100"].Labels["__metrics_path__"]; ok {
+		t.Error("client labels changed")
+	}
+}
+
+func TestPollMaxLifetime(t *testing.T) {
+	h := newTestHandler(coordinator.Options{PollMaxLifetime: 50 * time.Millisecond}, Options{})
+	defer h.coordinator.StopGC()
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/poll", strings.NewReader("host:9100")))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 5*time.Second {
+		t.Errorf("poll released after %s, want about 50ms", d)
+	}
+	// Still registered, the client only has to poll again.
+	if known := h.coordinator.KnownClients(); len(known) != 1 || known[0] != "host:9100" {
+		t.Errorf("got known clients %v, want host:9100", known)
+	}
+}
+
+// Poll h for fqdn as a client would, returning the scrape handed out or nil
+// if the poll was released without one.
+func pollOnce(h *Handler, fqdn string) *http.Request {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/poll", strings.NewReader(fqdn)))
+	if w.Code != http.StatusOK {
+		return nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(w.Body))
+	if err != nil {
+		return nil
+	}
+	return req
+}
+
+// A response with status and body, as a client pushes it.
+func textResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// Push resp for the scrape req to h as a client would, returning the status of the push.
+func push(h *Handler, req *http.Request, resp *http.Response) int {
+	resp.Header.Set(util.IDHeader, req.Header.Get(util.IDHeader))
+	var buf bytes.Buffer
+	resp.Write(&buf)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/push", &buf))
+	return w.Code
+}
+
+// Scrape url through h as Prometheus would, while a client for its host
+// answers the scrape with what respond returns.
+func scrapeThrough(h *Handler, url string, respond func(*http.Request) *http.Response) *httptest.ResponseRecorder {
+	scrape := httptest.NewRequest("GET", url, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if req := pollOnce(h, scrape.URL.Host); req != nil {
+			push(h, req, respond(req))
+		}
+	}()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, scrape)
+	<-done
+	return w
+}
+
+func TestScrapeStripsInternalHeaders(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{})
+	defer h.coordinator.StopGC()
+
+	w := scrapeThrough(h, "http://host:9100/metrics", func(*http.Request) *http.Response {
+		resp := textResponse(http.StatusOK, "up 1\n")
+		resp.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+		resp.Header.Set("X-Prometheus-Scrape-Timeout", "10s")
+		resp.Header.Set("X-Prom-Pull-Token", "secret")
+		resp.Header.Set("Content-Type", "text/plain")
+		return resp
+	})
+	if w.Code != http.StatusOK || w.Body.String() != "up 1\n" {
+		t.Fatalf("got %d %q, want the pushed result", w.Code, w.Body.String())
+	}
+	for _, name := range coordinator.DefaultStripHeaders {
+		if v := w.Header().Get(name); v != "" {
+			t.Errorf("%s: %q reached Prometheus", name, v)
+		}
+	}
+	if w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("Content-Type was stripped too")
+	}
+	if w.Header().Get(scrapeIDHeader) == "" {
+		t.Errorf("no %s header", scrapeIDHeader)
+	}
+}
+
+func TestClientsVerbose(t *testing.T) {
+	h := newTestHandler(coordinator.Options{PollMaxLifetime: time.Millisecond}, Options{})
+	defer h.coordinator.StopGC()
+	before := time.Now().Add(-time.Second)
+	poll := httptest.NewRequest("POST", "/poll", strings.NewReader("host:9100"))
+	poll.Header.Set("X-PushProx-Instance", "abc")
+	h.ServeHTTP(httptest.NewRecorder(), poll)
+
+	// The format http_sd_configs has always been given.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/clients", nil))
+	if want := `[{"targets":["host:9100"],"labels":null}]` + "\n"; w.Body.String() != want {
+		t.Errorf("got %s, want %s", w.Body.String(), want)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/clients?verbose=true", nil))
+	var groups []targetGroup
+	if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0].Targets) != 1 || groups[0].Targets[0] != "host:9100" {
+		t.Fatalf("got %s, want host:9100", w.Body.String())
+	}
+	lastSeen, err := time.Parse(time.RFC3339, groups[0].Labels["last_seen"])
+	if err != nil {
+		t.Fatalf("last_seen: %s", err)
+	}
+	if lastSeen.Before(before) || lastSeen.After(time.Now()) {
+		t.Errorf("got last_seen %s, want about now", lastSeen)
+	}
+	if got := groups[0].Labels["instance_id"]; got != "abc" {
+		t.Errorf("got instance_id %q, want abc", got)
+	}
+}
+
+func TestScrapeRateLimitPerRequester(t *testing.T) {
+	// Scrapes of unknown clients fail straight away, so they don't wait for one.
+	h := newTestHandler(coordinator.Options{RequireKnown: true}, Options{ScrapeRateLimit: 0.001, ScrapeRateBurst: 2})
+	defer h.coordinator.StopGC()
+	limited := testutil.ToFloat64(scrapeRateLimited)
+
+	scrape := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://host:9100/metrics", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := scrape("192.0.2.1:1234"); w.Code != http.StatusBadGateway {
+			t.Fatalf("scrape %d within the burst got %d, want %d", i, w.Code, http.StatusBadGateway)
+		}
+	}
+	w := scrape("192.0.2.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("scrape past the burst got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get(util.ScrapeErrorHeader); got != "rate_limited" {
+		t.Errorf("got scrape error %q, want rate_limited", got)
+	}
+	if got := testutil.ToFloat64(scrapeRateLimited) - limited; got != 1 {
+		t.Errorf("counted %v rate limited scrapes, want 1", got)
+	}
+	// Other requesters have their own limit.
+	if w := scrape("192.0.2.2:1234"); w.Code != http.StatusBadGateway {
+		t.Errorf("scrape of another requester got %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestPushLengthMismatch(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{})
+	defer h.coordinator.StopGC()
+	mismatches := testutil.ToFloat64(pushLengthMismatch)
+
+	for _, body := range []string{
+		// Truncated.
+		"HTTP/1.1 200 OK\r\nId: 1\r\nContent-Length: 10\r\n\r\nup 1\n",
+		// Longer than it says.
+		"HTTP/1.1 200 OK\r\nId: 1\r\nContent-Length: 2\r\n\r\nup 1\n",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/push", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if got := testutil.ToFloat64(pushLengthMismatch) - mismatches; got != 2 {
+		t.Errorf("counted %v mismatched pushes, want 2", got)
+	}
+
+	resp, err := readPushedResponse(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nup 1\n"), 0, 0)
+	if err != nil {
+		t.Fatalf("push of the right length: %s", err)
+	}
+	resp.Body.Close()
+}
+
+func TestScrapeEnqueueTimeout(t *testing.T) {
+	h := newTestHandler(coordinator.Options{EnqueueTimeout: 50 * time.Millisecond}, Options{})
+	defer h.coordinator.StopGC()
+
+	r := httptest.NewRequest("GET", "http://host:9100/metrics", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("scrape failed after %s, want about the enqueue timeout", d)
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if got := w.Header().Get(util.ScrapeErrorHeader); got != "no_client" {
+		t.Errorf("got scrape error %q, want no_client", got)
+	}
+}
+
+func TestPollForSeveralFQDNs(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{})
+	defer h.coordinator.StopGC()
+
+	// One client connection after the other, each registering both.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			req := pollOnce(h, "a.example:9100 B.example:9100")
+			if req == nil {
+				return
+			}
+			push(h, req, textResponse(http.StatusOK, "host "+req.URL.Host+"\n"))
+		}
+	}()
+	for _, host := range []string{"a.example:9100", "b.example:9100"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://"+host+"/metrics", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "host "+host+"\n" {
+			t.Errorf("scrape of %s got %d %q", host, w.Code, w.Body.String())
+		}
+	}
+	<-done
+	known := h.coordinator.KnownClients()
+	sort.Strings(known)
+	if len(known) != 2 || known[0] != "a.example:9100" || known[1] != "b.example:9100" {
+		t.Errorf("got known clients %v, want both", known)
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{RoutePrefix: "/pushprox/"})
+	defer h.coordinator.StopGC()
+
+	for path, want := range map[string]int{
+		"/pushprox/clients": http.StatusOK,
+		"/clients":          http.StatusNotFound,
+		"/pushprox":         http.StatusNotFound,
+		"/pushprox/unknown": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, want)
+		}
+	}
+
+	// Scrapes in proxy mode are not prefixed, while the client polls and
+	// pushes under the prefix.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/pushprox/poll", strings.NewReader("host:9100")))
+		req, err := http.ReadRequest(bufio.NewReader(w.Body))
+		if err != nil {
+			return
+		}
+		resp := textResponse(http.StatusOK, "up 1\n")
+		resp.Header.Set(util.IDHeader, req.Header.Get(util.IDHeader))
+		var buf bytes.Buffer
+		resp.Write(&buf)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/pushprox/push", &buf))
+	}()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://host:9100/metrics", nil))
+	<-done
+	if w.Code != http.StatusOK || w.Body.String() != "up 1\n" {
+		t.Errorf("scrape got %d %q, want the pushed result", w.Code, w.Body.String())
+	}
+
+	// Unprefixed client routes are unknown.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/poll", strings.NewReader("host:9100")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unprefixed poll got %d, want 404", w.Code)
+	}
+}
+
+func TestHTTP2Cancellation(t *testing.T) {
+	h := newTestHandler(coordinator.Options{PollMaxClients: 1}, Options{})
+	defer h.coordinator.StopGC()
+	returned := make(chan string, 2)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			// HTTP/2 requests never carry an absolute URL, so scrape in
+			// proxy mode as a forwarding proxy in front would.
+			r.URL.Scheme, r.URL.Host = "http", "target:9100"
+		}
+		h.ServeHTTP(w, r)
+		returned <- r.URL.Path
+	}))
+	if err := http2.ConfigureServer(server.Config, &http2.Server{}); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	resp, err := client.Get(server.URL + "/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	<-returned
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got HTTP/%d.%d, want HTTP/2", resp.ProtoMajor, resp.ProtoMinor)
+	}
+
+	// A poll and a scrape, each given up on by their requester.
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", server.URL+"/poll", strings.NewReader("other:9100")),
+		httptest.NewRequest("GET", server.URL+"/metrics", nil),
+	} {
+		req.RequestURI = ""
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		if _, err := client.Do(req.WithContext(ctx)); err == nil {
+			t.Errorf("%s %s answered, want it to wait", req.Method, req.URL.Path)
+		}
+		cancel()
+		select {
+		case <-returned:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s still being handled after cancellation", req.Method, req.URL.Path)
+		}
+	}
+	if h.coordinator.PollersFull() {
+		t.Error("cancelled poll still counted as waiting")
+	}
+}
+
+func TestScrapeRetry(t *testing.T) {
+	// As the client reports a target refusing the connection.
+	refused := func() *http.Response {
+		resp := textResponse(http.StatusInternalServerError, "Failed to scrape: connection refused\n")
+		resp.Header.Set(util.ScrapeErrorHeader, "upstream")
+		return resp
+	}
+	for name, c := range map[string]struct {
+		retries    int
+		responses  []*http.Response
+		wantStatus int
+	}{
+		"retry succeeds":  {1, []*http.Response{refused(), textResponse(http.StatusOK, "up 1\n")}, http.StatusOK},
+		"retries run out": {1, []*http.Response{refused(), refused()}, http.StatusInternalServerError},
+		"no retries":      {0, []*http.Response{refused()}, http.StatusInternalServerError},
+		"not retryable":   {1, []*http.Response{textResponse(http.StatusNotFound, "")}, http.StatusNotFound},
+	} {
+		h := newTestHandler(coordinator.Options{}, Options{ScrapeRetries: c.retries, ScrapeRetryStatus: []int{http.StatusInternalServerError}})
+		done := make(chan int)
+		go func() {
+			pushed := 0
+			for _, resp := range c.responses {
+				req := pollOnce(h, "host:9100")
+				if req == nil {
+					break
+				}
+				push(h, req, resp)
+				pushed++
+			}
+			done <- pushed
+		}()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://host:9100/metrics", nil))
+		if pushed := <-done; pushed != len(c.responses) {
+			t.Errorf("%s: client answered %d scrapes, want %d", name, pushed, len(c.responses))
+		}
+		if w.Code != c.wantStatus {
+			t.Errorf("%s: got status %d, want %d", name, w.Code, c.wantStatus)
+		}
+		h.coordinator.StopGC()
+	}
+}
+
+func TestScrapeInjectsLabels(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{InjectLabels: []string{"site=fra1"}, DropMetrics: []string{"go_.*"}})
+	defer h.coordinator.StopGC()
+
+	w := scrapeThrough(h, "http://host:9100/metrics", func(*http.Request) *http.Response {
+		resp := textResponse(http.StatusOK, "go_goroutines 8\nup 1\nhttp_requests_total{code=\"200\"} 3\n")
+		resp.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		return resp
+	})
+	want := "up{site=\"fra1\"} 1\nhttp_requests_total{site=\"fra1\",code=\"200\"} 3\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("got %d %q, want %q", w.Code, w.Body.String(), want)
+	}
+}
+
+func TestScrapeTrailers(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		h := newTestHandler(coordinator.Options{}, Options{PushStream: stream})
+		w := scrapeThrough(h, "http://host:9100/metrics", func(*http.Request) *http.Response {
+			return &http.Response{
+				StatusCode:       http.StatusOK,
+				ProtoMajor:       1,
+				ProtoMinor:       1,
+				Header:           http.Header{},
+				ContentLength:    -1,
+				TransferEncoding: []string{"chunked"},
+				Body:             ioutil.NopCloser(strings.NewReader("up 1\n")),
+				Trailer:          http.Header{"X-Checksum": {"abc"}},
+			}
+		})
+		h.coordinator.StopGC()
+		resp := w.Result()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if w.Code != http.StatusOK || string(body) != "up 1\n" {
+			t.Errorf("stream %v: got %d %q, want the pushed result", stream, w.Code, body)
+		}
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+			t.Errorf("stream %v: got trailer %q, want %q", stream, got, "abc")
+		}
+	}
+}
+
+func TestScrapeIDReachesClient(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{})
+	defer h.coordinator.StopGC()
+
+	var header, param string
+	w := scrapeThrough(h, "http://host:9100/metrics", func(req *http.Request) *http.Response {
+		header, param = req.Header.Get(util.IDHeader), req.URL.Query().Get(util.IDParam)
+		return textResponse(http.StatusOK, "up 1\n")
+	})
+	id := w.Header().Get(scrapeIDHeader)
+	if w.Code != http.StatusOK || id == "" {
+		t.Fatalf("got %d with scrape ID %q", w.Code, id)
+	}
+	if header != id || param != id {
+		t.Errorf("client got ID %q in the header and %q in the URL, want %q", header, param, id)
+	}
+}
+
+func TestScrapeMatchesNormalizedFQDN(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{})
+	defer h.coordinator.StopGC()
+
+	for registered, scraped := range map[string]string{
+		"Host.Example.:9100": "http://host.example:9100/metrics",
+		"host.example":       "http://HOST.example./metrics",
+		"[2001:db8::1]:9100": "http://[2001:DB8::1]:9100/metrics",
+		"2001:db8::2":        "http://[2001:db8::2]/metrics",
+	} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if req := pollOnce(h, registered); req != nil {
+				push(h, req, textResponse(http.StatusOK, "up 1\n"))
+			}
+		}()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", scraped, nil))
+		<-done
+		if w.Code != http.StatusOK || w.Body.String() != "up 1\n" {
+			t.Errorf("registered %s, scraped %s: got %d %q", registered, scraped, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestScrapePassesNegotiation(t *testing.T) {
+	h := newTestHandler(coordinator.Options{}, Options{})
+	defer h.coordinator.StopGC()
+	const accept = "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+	const contentType = "application/openmetrics-text; version=0.0.1; charset=utf-8"
+
+	var gotAccept string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if req := pollOnce(h, "host:9100"); req != nil {
+			gotAccept = req.Header.Get("Accept")
+			resp := textResponse(http.StatusOK, "up 1\n# EOF\n")
+			resp.Header.Set("Content-Type", contentType)
+			push(h, req, resp)
+		}
+	}()
+	scrape := httptest.NewRequest("GET", "http://host:9100/metrics", nil)
+	scrape.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, scrape)
+	<-done
+	if gotAccept != accept {
+		t.Errorf("client got Accept %q, want %q", gotAccept, accept)
+	}
+	if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || got != contentType {
+		t.Errorf("got %d with Content-Type %q, want %q", w.Code, got, contentType)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Writes a newline to a waiting poll every interval, so NATs along the way
+// see traffic and don't drop the connection, and a client that is gone shows
+// up as a failed write which cancels the poll. Only done for clients that
+// ask for it, as they skip leading newlines and take a body of nothing but
+// newlines as the poll being released.
+type pollKeepalive struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Commits the response as a 200 and starts writing. cancel is called if a write fails.
+func startPollKeepalive(w http.ResponseWriter, interval time.Duration, cancel context.CancelFunc) *pollKeepalive {
+	k := &pollKeepalive{stop: make(chan struct{}), done: make(chan struct{})}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("X-PushProx-Keepalive-Seconds", strconv.FormatFloat(interval.Seconds(), 'f', -1, 64))
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	go func() {
+		defer close(k.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-k.stop:
+				return
+			case <-ticker.C:
+				if _, err := w.Write([]byte("\n")); err != nil {
+					cancel()
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	}()
+	return k
+}
+
+// Stop writing. Once this returns the caller may write to the response again.
+func (k *pollKeepalive) Stop() {
+	close(k.stop)
+	<-k.done
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	startTime = time.Now()
+
+	scrapeRateLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_scrape_rate_limited_total",
+			Help: "Number of scrapes rejected because the requester or the scraped FQDN exceeded its rate limit.",
+		},
+	)
+	pushLengthMismatch = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_push_length_mismatch_total",
+			Help: "Number of pushed scrape responses rejected because their body did not match their Content-Length.",
+		},
+	)
+	pollsRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_polls_rejected_total",
+			Help: "Number of polls turned away because --poll.max-clients clients were already polling.",
+		},
+	)
+	invalidScrapes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_invalid_scrapes_total",
+			Help: "Number of scrape results that did not parse with --scrape.validate-metrics.",
+		},
+	)
+	scrapeAmplification = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_scrape_amplification_ratio",
+			Help:    "Bytes sent back to the requester per byte of scrape request.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scrapeRateLimited, scrapeAmplification, pushLengthMismatch, pollsRejected, invalidScrapes)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Keeps track of the server's connections for Options.PushBodyTimeout, to be
+// used as its http.Server.ConnState.
+func (h *Handler) TrackConn(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		h.conns.Store(c.RemoteAddr().String(), c)
+	case http.StateHijacked, http.StateClosed:
+		h.conns.Delete(c.RemoteAddr().String())
+	}
+}
+
+// The connection r came in on, nil if it is not known or, as with HTTP/2,
+// shared with other requests.
+func (h *Handler) requestConn(r *http.Request) net.Conn {
+	if r.ProtoMajor != 1 {
+		return nil
+	}
+	c, ok := h.conns.Load(r.RemoteAddr)
+	if !ok {
+		return nil
+	}
+	return c.(net.Conn)
+}
+
+// A request body whose reads fail once nothing arrives on conn for timeout,
+// and keep failing after that.
+type stallReader struct {
+	io.ReadCloser
+	conn    net.Conn
+	timeout time.Duration
+	err     error
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	n, err := s.ReadCloser.Read(p)
+	if isTimeout(err) {
+		s.err = err
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Returned by readPushedResponse when the push stalled for Options.PushBodyTimeout.
+type pushStalledError struct {
+	// The scrape the push was for, empty if its headers did not get through.
+	id  string
+	err error
+}
+
+func (e pushStalledError) Error() string {
+	return "push stalled: " + e.err.Error()
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/adobe/pushprox/util"
+)
+
+// The body of a failed scrape for scrapers that accept JSON.
+type scrapeErrorBody struct {
+	Error string `json:"error"`
+	// Empty if the scrape never got to a client.
+	ScrapeID string `json:"scrape_id"`
+	Target   string `json:"target"`
+}
+
+// Whether the Accept header in h lists application/json, other than with q=0.
+func acceptsJSON(h http.Header) bool {
+	for _, v := range h["Accept"] {
+		for _, part := range strings.Split(v, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil || mediaType != "application/json" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Fail the scrape r of target with msg, like http.Error. Scrapers that accept
+// JSON get a scrapeErrorBody instead, with the scrape ID already set in
+// scrapeIDHeader on w.
+func scrapeError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	if !acceptsJSON(r.Header) {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(scrapeErrorBody{
+		Error:    msg,
+		ScrapeID: w.Header().Get(scrapeIDHeader),
+		Target:   r.URL.String(),
+	})
+}
+
+// How much of a failed scrape a client pushed is turned into the error of a
+// scrapeErrorBody. The client only pushes a short message.
+const maxPushedErrorBytes = 64 << 10
+
+// Pass on a failed scrape the client pushed as resp, as JSON if the scraper
+// asked for it. Returns false if the scraper did not, so resp is untouched.
+func copyScrapeError(w http.ResponseWriter, r *http.Request, resp *http.Response) bool {
+	if !acceptsJSON(r.Header) {
+		return false
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxPushedErrorBytes))
+	w.Header().Set(util.ScrapeErrorHeader, resp.Header.Get(util.ScrapeErrorHeader))
+	scrapeError(w, r, strings.TrimSpace(string(msg)), resp.StatusCode)
+	return true
+}
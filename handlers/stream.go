@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// A response body read straight from the /push request it arrived in.
+// Closing it tells the push it can finish.
+type streamBody struct {
+	io.ReadCloser
+	once sync.Once
+	done chan struct{}
+	// The first error reading the push, other than EOF. Only read after done.
+	err error
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	// Reads what is left, so the push isn't cut off.
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { close(b.done) })
+	return err
+}
+
+// Parse the headers of the scrape response a client is sending to /push,
+// leaving its body to be read from body as the scrape copies it out.
+// body must stay readable until the returned body is closed.
+func readStreamedResponse(body io.Reader) (*http.Response, *streamBody, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(body), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	sb := &streamBody{ReadCloser: resp.Body, done: make(chan struct{})}
+	resp.Body = sb
+	return resp, sb, nil
+}
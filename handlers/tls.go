@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Check that r came with a verified client certificate whose SANs cover
+// the host of every key the client wants to register.
+func checkClientCert(r *http.Request, keys []string) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("a client certificate is required to poll")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, key := range keys {
+		host, _, err := net.SplitHostPort(key)
+		if err != nil {
+			host = key
+		}
+		if err := cert.VerifyHostname(host); err != nil {
+			return fmt.Errorf("client certificate is not valid for %s", host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Rewrites scrape bodies in the Prometheus text format on their way back to
+// Prometheus, one line at a time so large bodies are never held in memory.
+type transformer struct {
+	// Label pair inserted into every sample, already formatted as name="value".
+	labels []string
+	// Names of labels being injected, to avoid duplicating one the sample has.
+	labelNames []string
+	// Metrics whose names match any of these are dropped.
+	drop []*regexp.Regexp
+}
+
+// Build a transformer from the InjectLabels and DropMetrics options.
+// Returns nil if there is nothing to do.
+func newTransformer(injectLabels, dropMetrics []string) (*transformer, error) {
+	if len(injectLabels) == 0 && len(dropMetrics) == 0 {
+		return nil, nil
+	}
+	t := &transformer{}
+	for _, l := range injectLabels {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", l)
+		}
+		t.labelNames = append(t.labelNames, parts[0])
+		t.labels = append(t.labels, parts[0]+`="`+labelValueEscaper.Replace(parts[1])+`"`)
+	}
+	for _, d := range dropMetrics {
+		re, err := regexp.Compile("^(?:" + d + ")$")
+		if err != nil {
+			return nil, err
+		}
+		t.drop = append(t.drop, re)
+	}
+	return t, nil
+}
+
+// Escapes a label value the way the text format expects it between quotes.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Whether the transformer understands a body with header h. Anything but the
+// protobuf format is treated as text, uncompressed or gzipped.
+func (t *transformer) handles(h http.Header) bool {
+	if strings.HasPrefix(h.Get("Content-Type"), "application/vnd.google.protobuf") {
+		return false
+	}
+	switch h.Get("Content-Encoding") {
+	case "", "identity", "gzip":
+		return true
+	}
+	return false
+}
+
+func (t *transformer) dropped(name string) bool {
+	for _, re := range t.drop {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Like Copy, for a body with Content-Encoding encoding. A gzipped body is
+// decompressed to be transformed and compressed again.
+func (t *transformer) CopyEncoded(w io.Writer, r io.Reader, encoding string) (int64, error) {
+	if encoding != "gzip" {
+		return t.Copy(w, r)
+	}
+	gr, err := gzip.NewReader(r)
+	if err == io.EOF {
+		// Nothing to transform.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer gr.Close()
+	cw := &countingWriter{w: w}
+	gw := gzip.NewWriter(cw)
+	if _, err := t.Copy(gw, gr); err != nil {
+		return cw.n, err
+	}
+	err = gw.Close()
+	return cw.n, err
+}
+
+// Counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Copy r to w, applying the transformation. Returns the number of bytes written.
+func (t *transformer) Copy(w io.Writer, r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var written int64
+	for {
+		line, readErr := br.ReadString('\n')
+		if line != "" {
+			out, keep := t.line(line)
+			if keep {
+				n, err := io.WriteString(w, out)
+				written += int64(n)
+				if err != nil {
+					return written, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// Transform a single line, returning false if it should be dropped.
+func (t *transformer) line(line string) (string, bool) {
+	trimmed := strings.TrimLeft(line, " \t")
+	if trimmed == "" || trimmed == "\n" {
+		return line, true
+	}
+	if strings.HasPrefix(trimmed, "#") {
+		// # HELP name ... and # TYPE name ... go with their metric.
+		fields := strings.Fields(trimmed)
+		if len(fields) >= 3 && (fields[1] == "HELP" || fields[1] == "TYPE") && t.dropped(fields[2]) {
+			return "", false
+		}
+		return line, true
+	}
+	end := strings.IndexAny(trimmed, "{ \t")
+	if end < 0 {
+		return line, true
+	}
+	name := trimmed[:end]
+	if t.dropped(name) {
+		return "", false
+	}
+	if len(t.labels) == 0 {
+		return line, true
+	}
+	rest := trimmed[end:]
+	if !strings.HasPrefix(rest, "{") {
+		return name + "{" + strings.Join(t.labels, ",") + "}" + rest, true
+	}
+	labels := make([]string, 0, len(t.labels))
+	for i, l := range t.labels {
+		// Don't clash with a label the target already set.
+		if strings.Contains(rest, "{"+t.labelNames[i]+"=") || strings.Contains(rest, ","+t.labelNames[i]+"=") {
+			continue
+		}
+		labels = append(labels, l)
+	}
+	if len(labels) == 0 {
+		return line, true
+	}
+	sep := ","
+	if strings.HasPrefix(rest, "{}") {
+		sep = ""
+	}
+	return name + "{" + strings.Join(labels, ",") + sep + rest[1:], true
+}
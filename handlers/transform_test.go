@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTransformerLines(t *testing.T) {
+	tr, err := newTransformer([]string{`site=a"b\c`}, []string{"go_.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := `# HELP go_goroutines Number of goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 8
+# TYPE up gauge
+up 1
+http_requests_total{code="200"} 3
+http_requests_total{} 4
+node{site="x"} 5
+`
+	want := `# TYPE up gauge
+up{site="a\"b\\c"} 1
+http_requests_total{site="a\"b\\c",code="200"} 3
+http_requests_total{site="a\"b\\c"} 4
+node{site="x"} 5
+`
+	var out bytes.Buffer
+	if _, err := tr.Copy(&out, strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestTransformerEscapesNewline(t *testing.T) {
+	tr, _ := newTransformer([]string{"note=a\nb"}, nil)
+	if got, want := tr.labels[0], `note="a\nb"`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestTransformerHandles(t *testing.T) {
+	tr, _ := newTransformer(nil, []string{"x"})
+	for _, c := range []struct {
+		contentType, encoding string
+		want                  bool
+	}{
+		{"text/plain; version=0.0.4", "", true},
+		{"text/plain; version=0.0.4", "gzip", true},
+		{"text/plain; version=0.0.4", "br", false},
+		{"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily", "", false},
+	} {
+		h := http.Header{}
+		h.Set("Content-Type", c.contentType)
+		if c.encoding != "" {
+			h.Set("Content-Encoding", c.encoding)
+		}
+		if got := tr.handles(h); got != c.want {
+			t.Errorf("handles(%q, %q) = %v, want %v", c.contentType, c.encoding, got, c.want)
+		}
+	}
+}
+
+func TestTransformerGzip(t *testing.T) {
+	tr, _ := newTransformer([]string{"site=a"}, nil)
+	var out bytes.Buffer
+	n, err := tr.CopyEncoded(&out, bytes.NewReader(gzipped([]byte("up 1\n"))), "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("%d bytes reported, %d written", n, out.Len())
+	}
+	gr, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(gr)
+	if got, want := string(b), "up{site=\"a\"} 1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
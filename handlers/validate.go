@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Set on scrape results that failed Options.ValidateMetrics, to the parse error.
+const invalidMetricsHeader = "X-PushProx-Invalid-Metrics"
+
+// Whether resp is a successful scrape in the text format the parser
+// understands, uncompressed or gzipped.
+func validatable(resp *http.Response) bool {
+	if resp.StatusCode/100 != 2 || resp.Header.Get(util.ScrapeErrorHeader) != "" {
+		return false
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "gzip" {
+		return false
+	}
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	return err == nil && mediaType == "text/plain"
+}
+
+// Read the body of resp whole and parse it, replacing the body with what was
+// read, in a temporary file past spillThreshold bytes.
+// Returns the buffer holding it, to be closed once the body is no longer
+// needed, and the parse error if it did not parse.
+// err is set if the body could not be read, in which case resp is left unusable.
+func validateBody(resp *http.Response, spillThreshold int64) (buf *util.SpillBuffer, parseErr error, err error) {
+	buf = util.NewSpillBuffer(spillThreshold)
+	if _, err := io.Copy(buf, resp.Body); err != nil {
+		buf.Close()
+		return nil, nil, err
+	}
+	resp.Body = ioutil.NopCloser(buf.Reader())
+	r := buf.Reader()
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return buf, err, nil
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var parser expfmt.TextParser
+	_, parseErr = parser.TextToMetricFamilies(r)
+	return buf, parseErr, nil
+}
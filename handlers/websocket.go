@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/net/websocket"
+)
+
+// Serve a client connected to /ws instead of polling.
+// The client first sends its keys, as it would in a /poll body. The proxy then
+// sends every scrape request as /poll would answer it, and the client sends
+// back each result as the /push request it would otherwise have made, so one
+// connection replaces a poll and a push per scrape. Blocking.
+func (h *Handler) serveWebsocket(ws *websocket.Conn) {
+	defer ws.Close()
+	r := ws.Request()
+	if h.opts.PushMaxBodyBytes > 0 {
+		ws.MaxPayloadBytes = int(h.opts.PushMaxBodyBytes)
+	}
+
+	var body string
+	if err := websocket.Message.Receive(ws, &body); err != nil {
+		level.Warn(h.logger).Log("msg", "Error reading keys from /ws", "requester", requesterIP(r), "err", err)
+		return
+	}
+	keys := pollKeys(body)
+	if len(keys) == 0 {
+		level.Warn(h.logger).Log("msg", "No FQDN in /ws", "requester", requesterIP(r))
+		return
+	}
+	if h.opts.RequireClientCert {
+		if err := checkClientCert(r, keys); err != nil {
+			level.Warn(h.logger).Log("msg", "Rejected /ws", "requester", requesterIP(r), "fqdn", strings.Join(keys, ","), "err", err)
+			return
+		}
+	}
+	info := pollClientInfo(r, h.logger)
+	if err := h.coordinator.CheckRegistration(keys, info); err != nil {
+		level.Warn(h.logger).Log("msg", "Rejected /ws", "requester", requesterIP(r), "fqdn", strings.Join(keys, ","), "err", err)
+		return
+	}
+	key := strings.Join(keys, ",")
+	level.Info(h.logger).Log("msg", "Client connected over /ws", "fqdn", key)
+
+	// Read pushes until the connection breaks, which also ends the wait for scrapes.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				level.Info(h.logger).Log("msg", "Client disconnected from /ws", "fqdn", key, "err", err)
+				return
+			}
+			push, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+			if err != nil {
+				level.Error(h.logger).Log("msg", "Error reading push from /ws", "fqdn", key, "err", err)
+				continue
+			}
+			// Pushes arrive whole, streaming would only hold up the next one.
+			h.pushResult(push.Body, push.Header.Get("Content-Encoding"), false)
+		}
+	}()
+
+	// The connection stays up, so register again every poll interval to keep the client known.
+	refresh := h.coordinator.RefreshInterval(info)
+	for ctx.Err() == nil && !h.coordinator.Draining() {
+		// Not a timeout on ctx, that would drop a scrape handed over just as it fires.
+		timer := time.NewTimer(refresh)
+		request, doscrape := h.coordinator.WaitForScrapeInstruction(ctx, keys, info, timer.C)
+		timer.Stop()
+		if !doscrape {
+			continue
+		}
+		var buf bytes.Buffer
+		writeScrapeRequest(&buf, request)
+		ws.SetWriteDeadline(time.Now().Add(h.coordinator.ScrapeTimeout(request.Header)))
+		if err := websocket.Message.Send(ws, buf.Bytes()); err != nil {
+			level.Error(h.logger).Log("msg", "Error sending scrape over /ws", "fqdn", key, "scrape_id", request.Header.Get(util.IDHeader), "err", err)
+			return
+		}
+		level.Debug(h.logger).Log("msg", "Sent scrape over /ws", "url", request.URL.String(), "scrape_id", request.Header.Get(util.IDHeader))
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Enables TCP keepalives on accepted connections, as http.Server.ListenAndServe
+// does, so the kernel eventually notices peers that vanished without closing.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l tcpKeepAliveListener) Accept() (net.Conn, error) {
+	tc, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(l.period)
+	return tc, nil
+}
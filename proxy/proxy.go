@@ -1,130 +1,275 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/ioutil"
+	"crypto/tls"
+	"net"
 	"net/http"
-	"strings"
-	"regexp"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/adobe/pushprox/coordinator"
+	"github.com/adobe/pushprox/handlers"
+	"github.com/adobe/pushprox/util"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"golang.org/x/net/http2"
 
 	"github.com/go-kit/kit/log/level"
 	glog "github.com/go-kit/kit/log"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
+	"github.com/prometheus/common/version"
 
 )
 
 var (
 	listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for proxy and client requests.").Default(":8080").String()
 	loggerName   = kingpin.Flag("loggername", "Logger name to use so that the logs can be filtered").Default("proxyserver").String()
-) 
-
-func copyHTTPResponse(resp *http.Response, w http.ResponseWriter) {
-	for k, v := range resp.Header {
-		w.Header()[k] = v
-	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}
-
-type targetGroup struct {
-	Targets []string          `json:"targets"`
-	Labels  map[string]string `json:"labels"`
-}
+	routePrefix   = kingpin.Flag("web.route-prefix", "Prefix for the internal routes such as /poll and /push, for when the proxy is served under a sub-path by a reverse proxy.").Default("").String()
+	pushMaxBodyBytes = kingpin.Flag("push.max-body-bytes", "Largest /push body accepted from a client, larger ones get a 413. 0 disables.").Default("0").Int64()
+	injectLabels = kingpin.Flag("scrape.inject-label", "Label as name=value added to every sample of every scrape passing through the proxy. Repeatable.").Strings()
+	dropMetrics = kingpin.Flag("scrape.drop-metric", "Regex of metric names to drop from every scrape passing through the proxy. Repeatable.").Strings()
+	pushSpillThreshold = kingpin.Flag("push.spill-threshold-bytes", "Pushed bodies larger than this are buffered in a temporary file instead of memory. 0 disables.").Default("0").Int64()
+	scrapeRetries = kingpin.Flag("scrape.retries", "How many times to dispatch a scrape again when the client reports a retryable status.").Default("0").Int()
+	scrapeRetryStatus = kingpin.Flag("scrape.retry-status", "Status code from a client that is worth retrying. Repeatable.").Default("500", "502", "503", "504").Ints()
+	scrapeRateLimit = kingpin.Flag("scrape.rate-limit", "Scrapes per second allowed from a single requester IP before answering 429. 0 disables.").Default("0").Float64()
+	scrapeRateBurst = kingpin.Flag("scrape.rate-burst", "Scrapes a single requester IP may make in a burst above --scrape.rate-limit.").Default("10").Int()
+	tlsCertFile   = kingpin.Flag("web.tls-cert-file", "Path to the TLS certificate. Serves HTTPS when set along with --web.tls-key-file, reloaded on SIGHUP.").Default("").String()
+	pollKeepaliveInterval = kingpin.Flag("poll.keepalive-interval", "Write a byte to waiting polls of clients that support it this often, so NATs keep the connection open and dead clients are noticed. 0 disables.").Default("30s").Duration()
+	exposeSourceIP = kingpin.Flag("clients.expose-source-ip", "Add the IP each client last polled from to its targets in /clients as the source_ip label.").Default("false").Bool()
+	readHeaderTimeout = kingpin.Flag("web.read-header-timeout", "How long a client may take to send the headers of a request.").Default("10s").Duration()
+	readTimeout   = kingpin.Flag("web.read-timeout", "How long a request, including its body, may take to read. Must leave time for large /push bodies. 0 disables.").Default("0s").Duration()
+	idleTimeout   = kingpin.Flag("web.idle-timeout", "How long an idle keep-alive connection is kept open between requests.").Default("5m").Duration()
+	adminListenAddress = kingpin.Flag("web.admin-listen-address", "Serve /clients, /metrics, /healthz, /version and pprof on this separate address instead, without TLS or auth, leaving only scrapes and client endpoints on --web.listen-address.").Default("").String()
+	tcpKeepAlive  = kingpin.Flag("web.tcp-keepalive", "TCP keepalive period for client connections, to notice clients that vanished without closing the connection.").Default("3m").Duration()
+	shutdownTimeout = kingpin.Flag("web.shutdown-timeout", "How long to wait on SIGTERM for scrapes already handed to clients to be pushed before exiting.").Default("30s").Duration()
+	enablePprof   = kingpin.Flag("web.enable-pprof", "Serve Go profiling data under /debug/pprof/. Off by default, as it exposes internals of the proxy.").Default("false").Bool()
+	clientCAFile  = kingpin.Flag("web.client-ca-file", "CA certificates to verify client certificates against. When set, /poll requires a client certificate valid for every FQDN registered. Needs --web.tls-cert-file.").Default("").String()
+	authToken     = kingpin.Flag("web.auth-token", "Bearer token clients must send on /poll and /push. Empty disables.").Default("").String()
+	scrapeAuthToken = kingpin.Flag("web.scrape-auth-token", "Bearer token Prometheus must send when scraping through the proxy. Empty disables.").Default("").String()
+	tlsKeyFile    = kingpin.Flag("web.tls-key-file", "Path to the TLS private key. Serves HTTPS when set along with --web.tls-cert-file, reloaded on SIGHUP.").Default("").String()
+	registrationTimeout = kingpin.Flag("registration.timeout", "After how long a registration expires, for clients that do not advertise their poll interval.").Default("5m").Duration()
+	maxConcurrentScrapes = kingpin.Flag("scrape.max-concurrent", "Most scrapes the proxy handles at once, any more get a 429. 0 disables.").Default("0").Int()
+	enqueueTimeout      = kingpin.Flag("scrape.enqueue-timeout", "How long a scrape waits for a polling client to pick it up before failing with a 502. 0 waits for the whole scrape timeout.").Default("0s").Duration()
+	stripHeaders        = kingpin.Flag("push.strip-header", "Header to remove from pushed responses before they reach Prometheus. Repeatable, replaces the defaults.").Default(coordinator.DefaultStripHeaders...).Strings()
+	scrapeDedup         = kingpin.Flag("scrape.dedup", "Have identical scrapes that arrive while one is in flight wait for that one's result instead of scraping the client again.").Default("false").Bool()
+	requireKnown        = kingpin.Flag("scrape.require-known", "Fail scrapes of FQDNs no client has registered straight away with a 502, instead of waiting for one to show up.").Default("false").Bool()
+	gcInterval          = kingpin.Flag("registration.gc-interval", "How often clients whose registration expired are forgotten.").Default("1m").Duration()
+	fqdnRateLimit       = kingpin.Flag("scrape.fqdn-rate-limit", "Scrapes per second allowed of a single FQDN, from all requesters together, before answering 429. 0 disables.").Default("0").Float64()
+	fqdnRateBurst       = kingpin.Flag("scrape.fqdn-rate-burst", "Scrapes of a single FQDN allowed in a burst above --scrape.fqdn-rate-limit.").Default("10").Int()
+	pollMaxClients      = kingpin.Flag("poll.max-clients", "Most client connections waiting for scrapes at once, any more get a 503 with a Retry-After header. 0 disables.").Default("0").Int()
+	pollRetryAfter      = kingpin.Flag("poll.retry-after", "How long clients turned away by --poll.max-clients are asked to wait before polling again.").Default("30s").Duration()
+	rejectDuplicates    = kingpin.Flag("registration.reject-duplicates", "Refuse polls for an FQDN that a client with a different instance ID is polling for, instead of only warning.").Default("false").Bool()
+	maxRegistrations    = kingpin.Flag("registration.max-clients", "Most FQDNs registered at once, including expired ones not yet forgotten. Polls for further FQDNs get a 429. 0 disables.").Default("0").Int()
+	pendingQueue        = kingpin.Flag("scrape.pending-queue", "Most scrapes of one FQDN waiting for its client to poll, e.g. while it reconnects. Any more get a 429 straight away. 0 allows any number.").Default("0").Int()
+	pollMaxLifetime     = kingpin.Flag("poll.max-lifetime", "Release a waiting client after this long so it reconnects, possibly to another replica. 0 disables.").Default("0s").Duration()
+	scrapeSelectStrategy = kingpin.Flag("scrape.select-strategy", "Which of several client connections polling for the same FQDN gets a scrape: \"round-robin\" the one waiting longest, so they take turns, \"random\" any of them, \"weighted\" takes turns in proportion to the clients' --poll.weight.").Default("round-robin").Enum("round-robin", "random", "weighted")
+	fileSDPath = kingpin.Flag("clients.file-sd-path", "Also write the targets /clients lists to this file for file_sd_configs, rewritten when clients come and go.").Default("").String()
+	pushBodyTimeout = kingpin.Flag("push.body-timeout", "Give up on a /push whose body sends nothing for this long with a 408, and fail its scrape straight away. Only applies to HTTP/1 connections. 0 disables.").Default("0s").Duration()
+	pushStream = kingpin.Flag("push.stream", "Pass pushed scrape results on to Prometheus as they arrive instead of buffering them whole first. A push cut short then breaks the scrape's connection instead of failing it with an error status.").Default("false").Bool()
+	validateMetrics = kingpin.Flag("scrape.validate-metrics", "Parse successful scrape results in the Prometheus text format before passing them on, and mark those that don't parse with an X-PushProx-Invalid-Metrics header. Each result is held whole to do so.").Default("false").Bool()
+)
 
 func main() {
 	allowedLevel := promlog.AllowedLevel{}
 	flag.AddFlags(kingpin.CommandLine, &allowedLevel)
+	kingpin.Version(version.Print("pushprox-proxy"))
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
-	logger := promlog.New(allowedLevel)
+	logger := util.NewLogger(allowedLevel, *logFormat)
 	logger = glog.With(logger, "logger", *loggerName)
-	coordinator := NewCoordinator(logger)
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Proxy request
-		if r.URL.Host != "" {
-			timeout := GetScrapeTimeout(r.Header)
-			level.Debug(logger).Log("msg", "Scraping", "timeout",  timeout)
-			ctx, _ := context.WithTimeout(r.Context(), timeout)
-			request := r.WithContext(ctx)
-			request.RequestURI = ""
+	coord, err := coordinator.New(logger, coordinator.Options{
+		RegistrationTimeout:  *registrationTimeout,
+		GCInterval:           *gcInterval,
+		MaxConcurrentScrapes: *maxConcurrentScrapes,
+		EnqueueTimeout:       *enqueueTimeout,
+		StripHeaders:         *stripHeaders,
+		RequireKnown:         *requireKnown,
+		FQDNRateLimit:        *fqdnRateLimit,
+		FQDNRateBurst:        *fqdnRateBurst,
+		PollMaxClients:       *pollMaxClients,
+		RejectDuplicates:     *rejectDuplicates,
+		MaxRegistrations:     *maxRegistrations,
+		PendingQueue:         *pendingQueue,
+		PollMaxLifetime:      *pollMaxLifetime,
+		SelectStrategy:       *scrapeSelectStrategy,
+		DefaultScrapeTimeout: *defaultScrapeTimeout,
+		MaxScrapeTimeout:     *maxScrapeTimeout,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating coordinator", "err", err)
+		os.Exit(1)
+	}
+	prometheus.MustRegister(coord)
+	sec, err := newSecrets(logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading auth tokens and client CAs", "err", err)
+		os.Exit(1)
+	}
+	go sec.watchSignals()
+	handler, err := handlers.New(coord, logger, handlers.Options{
+		RoutePrefix:           *routePrefix,
+		SeparateAdmin:         *adminListenAddress != "",
+		Secrets:               sec,
+		RequireClientCert:     *clientCAFile != "",
+		PushMaxBodyBytes:      *pushMaxBodyBytes,
+		PushSpillThreshold:    *pushSpillThreshold,
+		PushStream:            *pushStream,
+		PushBodyTimeout:       *pushBodyTimeout,
+		InjectLabels:          *injectLabels,
+		DropMetrics:           *dropMetrics,
+		ScrapeRetries:         *scrapeRetries,
+		ScrapeRetryStatus:     *scrapeRetryStatus,
+		ScrapeDedup:           *scrapeDedup,
+		ScrapeRateLimit:       *scrapeRateLimit,
+		ScrapeRateBurst:       *scrapeRateBurst,
+		ValidateMetrics:       *validateMetrics,
+		PollKeepaliveInterval: *pollKeepaliveInterval,
+		PollRetryAfter:        *pollRetryAfter,
+		ExposeSourceIP:        *exposeSourceIP,
+		EnablePprof:           *enablePprof,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "Error parsing scrape transformation flags", "err", err)
+		os.Exit(1)
+	}
+	if *fileSDPath != "" {
+		go handler.WriteFileSDForever(*fileSDPath, *gcInterval)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
 
-			resp, err, disconnect := coordinator.DoScrape(ctx, request, w)
-			if disconnect {
-				level.Error(logger).Log("msg", "Scraping: Disconnected")
-				return
-			}
-			if err != nil {
-				level.Error(logger).Log("msg", "Error scraping:", "err", err, "url", request.URL.String())
-				http.Error(w, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), err.Error()), 500)
-				return
-			}
-			defer resp.Body.Close()
-			level.Debug(logger).Log("msg", "Scraping: Sending scrap response")
-			copyHTTPResponse(resp, w)
-			return
+	// No WriteTimeout, it would count the whole time a poll or scrape is waiting.
+	server := &http.Server{
+		Addr:              *listenAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	if *pushBodyTimeout > 0 {
+		server.ConnState = handler.TrackConn
+	}
+	var adminServer *http.Server
+	if *adminListenAddress != "" {
+		adminServer = &http.Server{
+			Addr:              *adminListenAddress,
+			Handler:           handler.Admin(),
+			ReadHeaderTimeout: *readHeaderTimeout,
+			ReadTimeout:       *readTimeout,
+			IdleTimeout:       *idleTimeout,
 		}
+	}
+	// Prometheus or a load balancer in front may speak HTTP/2, disconnects are
+	// picked up through the request context so streams are cancelled properly.
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		level.Error(logger).Log("msg", "Error configuring HTTP/2", "err", err)
+		os.Exit(1)
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		level.Error(logger).Log("msg", "--web.tls-cert-file and --web.tls-key-file must be specified together.")
+		os.Exit(1)
+	}
+	if *clientCAFile != "" && *tlsCertFile == "" {
+		level.Error(logger).Log("msg", "--web.client-ca-file requires --web.tls-cert-file and --web.tls-key-file.")
+		os.Exit(1)
+	}
 
-		// Client registering and asking for scrapes.
-		if r.URL.Path == "/poll" {
-			fqdn, _ := ioutil.ReadAll(r.Body)
-			r, _ := regexp.Compile(":.*$")
-			// the key is the FQDN and the port
-			key := strings.TrimSpace(string(fqdn))
-			if !r.MatchString(key) {
-				// assume port 80 if none specified in teh key.
-				key = key + ":80"
-			}
-			request, doscrape := coordinator.WaitForScrapeInstruction(w, key)
-			if doscrape {
-				request.WriteProxy(w) // Send full request as the body of the response.
-				level.Debug(logger).Log("msg", "Responded to /poll", "url", request.URL.String(), "scrape_id", request.Header.Get("Id"))
-			} else {
-				level.Info(logger).Log("msg", "Connection was closed by client ")
-
-			}
-			return
+	// On SIGTERM stop handing out scrapes and give those in flight time to finish.
+	drained := make(chan struct{})
+	go func() {
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+		<-term
+		level.Info(logger).Log("msg", "Received SIGTERM, draining", "timeout", *shutdownTimeout)
+		servers := []*http.Server{server}
+		if adminServer != nil {
+			servers = append(servers, adminServer)
 		}
+		shutdown(coord, *shutdownTimeout, logger, servers...)
+		close(drained)
+	}()
 
-		// Scrape response from client.
-		if r.URL.Path == "/push" {
-			buf := &bytes.Buffer{}
-			io.Copy(buf, r.Body)
-
-			scrapeResult, _ := http.ReadResponse(bufio.NewReader(buf), nil)
-			level.Info(logger).Log("msg", "Got /push", "scrape_id", scrapeResult.Header.Get("Id"))
-			err := coordinator.ScrapeResult(scrapeResult)
-			if err != nil {
-				level.Error(logger).Log("msg", "Error pushing:", "err", err, "scrape_id", scrapeResult.Header.Get("Id"))
-				http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
-			}
-			return
+	listener, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error listening", "address", *listenAddress, "err", err)
+		os.Exit(1)
+	}
+	listener = tcpKeepAliveListener{TCPListener: listener.(*net.TCPListener), period: *tcpKeepAlive}
+	if adminServer != nil {
+		adminListener, err := net.Listen("tcp", *adminListenAddress)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error listening", "address", *adminListenAddress, "err", err)
+			os.Exit(1)
 		}
-
-		if r.URL.Path == "/clients" {
-			known := coordinator.KnownClients()
-			targets := make([]*targetGroup, 0, len(known))
-			for _, k := range known {
-				targets = append(targets, &targetGroup{Targets: []string{k}})
+		level.Info(logger).Log("msg", "Listening for admin requests", "address", *adminListenAddress)
+		go func() {
+			if err := adminServer.Serve(adminListener); err != http.ErrServerClosed {
+				log.Fatal(err)
 			}
-			json.NewEncoder(w).Encode(targets)
-			level.Info(logger).Log("msg", "Responded to /clients", "client_count", len(known))
-			return
+		}()
+	}
+	var reloader *certReloader
+	if *tlsCertFile != "" {
+		reloader, err = newCertReloader(*tlsCertFile, *tlsKeyFile, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading TLS certificate", "err", err)
+			os.Exit(1)
 		}
+		go reloader.watchSignals()
+	}
+	err = serve(server, listener, reloader, sec, handler.SetReady, logger)
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
+	level.Info(logger).Log("msg", "Shutdown complete")
+}
 
-		http.Error(w, "404: Unknown path", 404)
-	})
+// Drain coord, and shut servers down once the scrapes in flight are done or
+// timeout has passed. Until then /push is still served, so clients can push
+// the results of scrapes they were handed before the drain.
+func shutdown(coord *coordinator.Coordinator, timeout time.Duration, logger glog.Logger, servers ...*http.Server) {
+	coord.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := coord.WaitIdle(ctx); err != nil {
+		level.Warn(logger).Log("msg", "Scrapes still in flight at the shutdown timeout", "err", err)
+	}
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			level.Warn(logger).Log("msg", "Shutdown did not complete cleanly", "err", err)
+		}
+	}
+	coord.StopGC()
+}
 
-	level.Info(logger).Log("msg", "Listening", "address", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+// Serve on listener, over TLS with the certificate of reloader unless it is
+// nil, plain HTTP otherwise. ready is called once the server is about to
+// accept connections. Blocking, like http.Server.Serve.
+func serve(server *http.Server, listener net.Listener, reloader *certReloader, sec *secrets, ready func(), logger glog.Logger) error {
+	if reloader == nil {
+		level.Info(logger).Log("msg", "Listening", "address", listener.Addr())
+		ready()
+		return server.Serve(listener)
+	}
+	// http2.ConfigureServer already set up the TLS config with h2 in NextProtos.
+	if server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{}
+	}
+	server.TLSConfig.GetCertificate = reloader.GetCertificate
+	if *clientCAFile != "" {
+		// Prometheus scraping through the proxy need not have a certificate,
+		// so only /poll insists on one.
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		server.TLSConfig.GetConfigForClient = sec.tlsConfig(server.TLSConfig.Clone())
+	}
+	level.Info(logger).Log("msg", "Listening", "address", listener.Addr(), "tls", true)
+	ready()
+	return server.ServeTLS(listener, "", "")
 }
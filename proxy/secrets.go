@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	authTokenFile       = kingpin.Flag("web.auth-token-file", "File holding the token for --web.auth-token instead, reloaded on SIGHUP.").Default("").String()
+	scrapeAuthTokenFile = kingpin.Flag("web.scrape-auth-token-file", "File holding the token for --web.scrape-auth-token instead, reloaded on SIGHUP.").Default("").String()
+)
+
+// The auth tokens and client CAs in effect. Those given as files are read
+// again on SIGHUP, like the serving certificate of certReloader.
+type secrets struct {
+	mu              sync.RWMutex
+	authToken       string
+	scrapeAuthToken string
+	clientCAs       *x509.CertPool
+	logger          log.Logger
+}
+
+func newSecrets(logger log.Logger) (*secrets, error) {
+	if *authToken != "" && *authTokenFile != "" {
+		return nil, errors.New("--web.auth-token and --web.auth-token-file can't be used together")
+	}
+	if *scrapeAuthToken != "" && *scrapeAuthTokenFile != "" {
+		return nil, errors.New("--web.scrape-auth-token and --web.scrape-auth-token-file can't be used together")
+	}
+	s := &secrets{logger: logger}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read every file again. If any of them fails, all the previous values are kept.
+func (s *secrets) reload() error {
+	authToken, err := tokenFromFlags(*authToken, *authTokenFile)
+	if err != nil {
+		return err
+	}
+	scrapeAuthToken, err := tokenFromFlags(*scrapeAuthToken, *scrapeAuthTokenFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if *clientCAFile != "" {
+		if clientCAs, err = util.LoadCAFile(*clientCAFile); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authToken = authToken
+	s.scrapeAuthToken = scrapeAuthToken
+	s.clientCAs = clientCAs
+	return nil
+}
+
+// The token given directly, or else read from file with surrounding whitespace trimmed.
+func tokenFromFlags(token, file string) (string, error) {
+	if file == "" {
+		return token, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token = strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.New(file + " is empty")
+	}
+	return token, nil
+}
+
+// Bearer token clients must send on /poll and /push, empty if none.
+func (s *secrets) AuthToken() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.authToken
+}
+
+// Bearer token Prometheus must send to scrape, empty if none.
+func (s *secrets) ScrapeAuthToken() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.scrapeAuthToken
+}
+
+// Used as tls.Config.GetConfigForClient, so every handshake verifies client
+// certificates against the current CAs. base is the server's TLS config.
+func (s *secrets) tlsConfig(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		c := base.Clone()
+		c.ClientCAs = s.clientCAs
+		return c, nil
+	}
+}
+
+// Reload everything every time a SIGHUP is received. Blocking.
+func (s *secrets) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := s.reload(); err != nil {
+			level.Error(s.logger).Log("msg", "Error reloading auth tokens and client CAs, keeping the previous ones", "err", err)
+			continue
+		}
+		level.Info(s.logger).Log("msg", "Reloaded auth tokens and client CAs")
+	}
+}
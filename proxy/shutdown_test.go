@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/pushprox/coordinator"
+	"github.com/adobe/pushprox/handlers"
+	"github.com/adobe/pushprox/util"
+	"github.com/go-kit/kit/log"
+)
+
+func TestShutdownFinishesScrapesInFlight(t *testing.T) {
+	coord, err := coordinator.New(log.NewNopLogger(), coordinator.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coord.StopGC()
+	handler, err := handlers.New(coord, log.NewNopLogger(), handlers.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	ready := make(chan struct{})
+	go func() { served <- serve(server, listener, nil, nil, func() { close(ready) }, log.NewNopLogger()) }()
+	<-ready
+	base := "http://" + listener.Addr().String()
+
+	// A client polls and is handed a scrape.
+	polled := make(chan *http.Request, 1)
+	go func() {
+		resp, err := http.Post(base+"/poll", "", strings.NewReader("host:9100"))
+		if err != nil {
+			t.Error(err)
+			close(polled)
+			return
+		}
+		defer resp.Body.Close()
+		req, err := http.ReadRequest(bufio.NewReader(resp.Body))
+		if err != nil {
+			t.Error(err)
+			close(polled)
+			return
+		}
+		polled <- req
+	}()
+	proxyURL, _ := url.Parse(base)
+	prometheus := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	scraped := make(chan result, 1)
+	go func() {
+		resp, err := prometheus.Get("http://host:9100/metrics")
+		if err != nil {
+			scraped <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		scraped <- result{status: resp.StatusCode, body: string(body)}
+	}()
+	req := <-polled
+	if req == nil {
+		t.FailNow()
+	}
+
+	// SIGTERM arrives while the client is scraping its target.
+	shutDown := make(chan struct{})
+	go func() {
+		shutdown(coord, 10*time.Second, log.NewNopLogger(), server)
+		close(shutDown)
+	}()
+	for !coord.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// New scrapes are turned away.
+	resp, err := prometheus.Get("http://other:9100/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("scrape while draining got %d, want 503", resp.StatusCode)
+	}
+
+	// The result is pushed over a new connection and still reaches Prometheus.
+	pushed := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, ContentLength: 5, Body: ioutil.NopCloser(strings.NewReader("up 1\n"))}
+	pushed.Header.Set(util.IDHeader, req.Header.Get(util.IDHeader))
+	var buf bytes.Buffer
+	pushed.Write(&buf)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err = client.Post(base+"/push", "", &buf)
+	if err != nil {
+		t.Fatalf("push while draining failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("push while draining got %d, want 200", resp.StatusCode)
+	}
+	if got := <-scraped; got.err != nil || got.status != http.StatusOK || got.body != "up 1\n" {
+		t.Errorf("scrape got %d %q %v, want the pushed result", got.status, got.body, got.err)
+	}
+
+	select {
+	case <-shutDown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown still waiting with no scrape in flight")
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("serve returned %v, want %v", err, http.ErrServerClosed)
+	}
+}
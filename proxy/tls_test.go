@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/http2"
+)
+
+// Write a self-signed certificate for 127.0.0.1 with the given serial to
+// dir, returning the cert and key files and the certificate itself.
+func writeSelfSignedCert(t *testing.T, dir string, serial int64) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "pushprox test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// Start serve on a free port, returning its address.
+func startServe(t *testing.T, reloader *certReloader) (*http.Server, string) {
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})}
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan struct{})
+	go serve(server, listener, reloader, nil, func() { close(ready) }, log.NewNopLogger())
+	<-ready
+	return server, listener.Addr().String()
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, cert := writeSelfSignedCert(t, dir, 1)
+	reloader, err := newCertReloader(certFile, keyFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, addr := startServe(t, reloader)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %s", err)
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+	if got := state.PeerCertificates[0].SerialNumber.Int64(); got != 1 {
+		t.Errorf("got certificate %d, want 1", got)
+	}
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("negotiated %q, want h2", state.NegotiatedProtocol)
+	}
+
+	// A rotated certificate is served once reloaded, as on SIGHUP.
+	writeSelfSignedCert(t, dir, 2)
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake after reload failed: %s", err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); got != 2 {
+		t.Errorf("got certificate %d after reload, want 2", got)
+	}
+}
+
+func TestServePlaintext(t *testing.T) {
+	server, addr := startServe(t, nil)
+	defer server.Close()
+
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Error("TLS handshake succeeded without a certificate")
+	}
+}
@@ -1,10 +1,6 @@
 package main
 
 import (
-	"net/http"
-	"strconv"
-	"time"
-
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -12,16 +8,5 @@ import (
 var (
 	maxScrapeTimeout     = kingpin.Flag("scrape.max-timeout", "Any scrape with a timeout higher than this will have to be clamped to this.").Default("5m").Duration()
 	defaultScrapeTimeout = kingpin.Flag("scrape.default-timeout", "If a scrape lacks a timeout, use this value.").Default("15s").Duration()
+	logFormat            = kingpin.Flag("log.format", "Output format of log messages. One of: [logfmt, json]").Default("logfmt").Enum("logfmt", "json")
 )
-
-func GetScrapeTimeout(h http.Header) time.Duration {
-	timeout := *defaultScrapeTimeout
-	timeoutSeconds, err := strconv.ParseFloat(h.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
-	if err == nil {
-		timeout = time.Duration(timeoutSeconds * 1e9)
-	}
-	if timeout > *maxScrapeTimeout {
-		timeout = *maxScrapeTimeout
-	}
-	return timeout
-}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"os"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/promlog"
+)
+
+// Like promlog.New, but can also log as JSON with format "json".
+func NewLogger(al promlog.AllowedLevel, format string) log.Logger {
+	if format != "json" {
+		return promlog.New(al)
+	}
+	var o level.Option
+	switch al.String() {
+	case "debug":
+		o = level.AllowDebug()
+	case "warn":
+		o = level.AllowWarn()
+	case "error":
+		o = level.AllowError()
+	default:
+		o = level.AllowInfo()
+	}
+	l := log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
+	l = level.NewFilter(l, o)
+	l = log.With(l, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+	return l
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Buffers data in memory up to a threshold and in a temporary file past it,
+// so large scrape bodies don't have to be held in RAM.
+type SpillBuffer struct {
+	threshold int64
+	mem       bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+// threshold of 0 or less keeps everything in memory.
+func NewSpillBuffer(threshold int64) *SpillBuffer {
+	return &SpillBuffer{threshold: threshold}
+}
+
+func (b *SpillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && (b.threshold <= 0 || b.size+int64(len(p)) <= b.threshold) {
+		n, err := b.mem.Write(p)
+		b.size += int64(n)
+		return n, err
+	}
+	if b.file == nil {
+		f, err := ioutil.TempFile("", "pushprox-")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		if _, err := f.Write(b.mem.Bytes()); err != nil {
+			return 0, err
+		}
+		b.mem.Reset()
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// How many bytes have been written.
+func (b *SpillBuffer) Len() int64 {
+	return b.size
+}
+
+// Drop everything past the first n bytes written.
+func (b *SpillBuffer) Truncate(n int64) error {
+	if n >= b.size {
+		return nil
+	}
+	b.size = n
+	if b.file == nil {
+		b.mem.Truncate(int(n))
+		return nil
+	}
+	if err := b.file.Truncate(n); err != nil {
+		return err
+	}
+	_, err := b.file.Seek(n, io.SeekStart)
+	return err
+}
+
+// A reader over everything written so far, from the start. Can be called
+// more than once, and the readers don't affect each other.
+func (b *SpillBuffer) Reader() io.Reader {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes())
+	}
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// Remove the temporary file, if any.
+func (b *SpillBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
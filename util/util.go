@@ -0,0 +1,50 @@
+// Package util holds what the packages of the proxy and the client have to
+// agree on or share. It must not define flags, see the comment on the flags
+// in either binary.
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header carrying the scrape ID between proxy and client.
+const IDHeader = "Id"
+
+// URL parameter the proxy also puts the scrape ID in, for when something
+// between proxy and client strips IDHeader.
+const IDParam = "_pushprox_id"
+
+// Set on failed scrapes to say where they failed: "upstream" when the client
+// could not scrape its target, anything else when the proxy gave up on it.
+const ScrapeErrorHeader = "X-PushProx-Scrape-Error"
+
+// The timeout of a scrape from its X-Prometheus-Scrape-Timeout-Seconds header.
+// A missing, unparseable or non-positive header gives defaultTimeout, and
+// anything above maxTimeout is clamped to it.
+func ParseScrapeTimeout(header string, defaultTimeout, maxTimeout time.Duration) time.Duration {
+	timeout := defaultTimeout
+	timeoutSeconds, err := strconv.ParseFloat(header, 64)
+	// NaN fails the comparison too.
+	if err == nil && timeoutSeconds > 0 {
+		// Compared as seconds first, as huge values overflow a Duration.
+		if timeoutSeconds >= maxTimeout.Seconds() {
+			return maxTimeout
+		}
+		timeout = time.Duration(timeoutSeconds * 1e9)
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	return timeout
+}
+
+// A copy of h that can be changed without changing h.
+func CloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
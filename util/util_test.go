@@ -0,0 +1,35 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScrapeTimeout(t *testing.T) {
+	const def, max = 15 * time.Second, 5 * time.Minute
+	for _, c := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", def},
+		{"garbage", def},
+		{"-3", def},
+		{"0", def},
+		{"NaN", def},
+		{"10", 10 * time.Second},
+		{"0.5", 500 * time.Millisecond},
+		{"600", max},
+		{"Inf", max},
+		{"1e300", max},
+	} {
+		if got := ParseScrapeTimeout(c.header, def, max); got != c.want {
+			t.Errorf("ParseScrapeTimeout(%q) = %v, want %v", c.header, got, c.want)
+		}
+	}
+}
+
+func TestParseScrapeTimeoutClampsDefault(t *testing.T) {
+	if got := ParseScrapeTimeout("", time.Minute, 10*time.Second); got != 10*time.Second {
+		t.Errorf("got %v, want the maximum", got)
+	}
+}